@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/covince/covince-backend-v2/api"
+	"github.com/covince/covince-backend-v2/covince"
+)
+
+type adminOpts struct {
+	Dataset *covince.Dataset
+	Cache   *api.ResultCache
+	// records the deltas applied, if not nil
+	Journal *journal
+	// the number of metadata columns of a delta row
+	Columns int
+	// bytes the data may take, or zero for no limit
+	MemoryLimit int
+	Token       string
+}
+
+// the count of a tombstone, which deletes the record with the row's key
+const TOMBSTONE = "-"
+
+// the largest delta accepted in one request
+const MAX_DELTA_BYTES = 64 << 20
+
+// parseDeltaRow reads a row in the format of the main csv file.
+func parseDeltaRow(row []string, columns int) (covince.Row, error) {
+	if len(row) < 6+columns {
+		return covince.Row{}, fmt.Errorf("expected %v columns, got %v", 6+columns, len(row))
+	}
+	var mutations []string
+	if row[4] != "" {
+		mutations = strings.Split(row[4], "|")
+	}
+	r := covince.Row{
+		Area:       row[0],
+		Date:       row[1],
+		PangoClade: row[3],
+		Mutations:  mutations,
+		Metadata:   row[6 : 6+columns],
+		Deleted:    row[5] == TOMBSTONE,
+	}
+	if !r.Deleted {
+		count, err := strconv.Atoi(row[5])
+		if err != nil {
+			return covince.Row{}, fmt.Errorf("invalid count %q", row[5])
+		}
+		r.Count = count
+	}
+	return r, nil
+}
+
+func readDelta(r io.Reader, columns int) ([]covince.Row, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer([]byte{}, 2048*1024)
+	var rows []covince.Row
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		row, err := parseDeltaRow(strings.Split(scanner.Text(), ","), columns)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", line, err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(v)
+}
+
+func writeAdminError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, map[string]string{"error": err.Error()})
+}
+
+type memoryResponse struct {
+	Footprint covince.Footprint `json:"footprint"`
+	Limit     int               `json:"limit"`
+	HeapAlloc uint64            `json:"heapAlloc"`
+	Sys       uint64            `json:"sys"`
+}
+
+func delta(rw http.ResponseWriter, r *http.Request, opts *adminOpts) {
+	if r.Method != "POST" {
+		writeAdminError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	rows, err := readDelta(http.MaxBytesReader(rw, r.Body, MAX_DELTA_BYTES), opts.Columns)
+	if err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	start := time.Now()
+	result, err := opts.Journal.upsert(opts.Dataset, rows, time.Now().UnixMilli())
+	if errors.Is(err, covince.ErrMemoryLimit) {
+		writeAdminError(rw, http.StatusInsufficientStorage, err)
+		return
+	}
+	if errors.Is(err, errNotJournaled) {
+		log.Println(err)
+		writeAdminError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	if err != nil {
+		writeAdminError(rw, http.StatusBadRequest, err)
+		return
+	}
+	if len(result.Dropped) > 0 {
+		log.Println("Dropped indexes over the memory limit:", result.Dropped)
+	}
+	log.Println("delta:", result.Inserted, "inserted,", result.Updated, "updated,", result.Deleted, "deleted in", time.Since(start))
+	writeJSON(rw, http.StatusOK, result)
+}
+
+func memory(rw http.ResponseWriter, r *http.Request, opts *adminOpts) {
+	if r.Method != "GET" {
+		writeAdminError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	writeJSON(rw, http.StatusOK, memoryResponse{
+		Footprint: opts.Dataset.Current().Planner.Footprint(),
+		Limit:     opts.MemoryLimit,
+		HeapAlloc: m.HeapAlloc,
+		Sys:       m.Sys,
+	})
+}
+
+func cache(rw http.ResponseWriter, r *http.Request, opts *adminOpts) {
+	if r.Method != "GET" {
+		writeAdminError(rw, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+	writeJSON(rw, http.StatusOK, opts.Cache.Stats())
+}
+
+// admin serves requests bearing the token:
+//
+//	POST /admin/delta with a csv body upserts its rows, or deletes the
+//	records of rows with a count of "-"
+//	GET /admin/memory reports the bytes used by the data, in total and by the
+//	runtime
+//	GET /admin/cache reports the hits, misses and size of the result cache
+func admin(opts adminOpts) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+opts.Token)) != 1 {
+			writeAdminError(rw, http.StatusUnauthorized, fmt.Errorf("invalid token"))
+			return
+		}
+		switch r.URL.Path {
+		case "/admin/delta":
+			delta(rw, r, &opts)
+		case "/admin/memory":
+			memory(rw, r, &opts)
+		case "/admin/cache":
+			cache(rw, r, &opts)
+		default:
+			writeAdminError(rw, http.StatusNotFound, fmt.Errorf("not found"))
+		}
+	}
+}
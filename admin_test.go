@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/covince/covince-backend-v2/api"
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDeltaRow(t *testing.T) {
+	for _, c := range []struct {
+		line     string
+		expected covince.Row
+		err      string
+	}{
+		{
+			line:     "E1,2021-01-01,B.1.1.7,B.1.1.7.,S:N501Y|S:D614G,3,hospital",
+			expected: covince.Row{Area: "E1", Date: "2021-01-01", PangoClade: "B.1.1.7.", Mutations: []string{"S:N501Y", "S:D614G"}, Count: 3, Metadata: []string{"hospital"}},
+		},
+		{
+			line:     "E1,2021-01-01,B,B.,,2,community",
+			expected: covince.Row{Area: "E1", Date: "2021-01-01", PangoClade: "B.", Count: 2, Metadata: []string{"community"}},
+		},
+		{
+			line:     "E1,2021-01-01,B,B.,S:D614G,-,community",
+			expected: covince.Row{Area: "E1", Date: "2021-01-01", PangoClade: "B.", Mutations: []string{"S:D614G"}, Deleted: true, Metadata: []string{"community"}},
+		},
+		{line: "E1,2021-01-01,B,B.,,2", err: "expected 7 columns, got 6"},
+		{line: "E1,2021-01-01", err: "expected 7 columns, got 2"},
+		{line: "E1,2021-01-01,B,B.,,two,community", err: `invalid count "two"`},
+		{line: "E1,2021-01-01,B,B.,,,community", err: `invalid count ""`},
+	} {
+		row, err := parseDeltaRow(strings.Split(c.line, ","), 1)
+		if c.err != "" {
+			assert.EqualError(t, err, c.err, c.line)
+			continue
+		}
+		assert.Nil(t, err, c.line)
+		assert.Equal(t, c.expected, row, c.line)
+	}
+
+	_, err := readDelta(strings.NewReader("E1,2021-01-01,B,B.,,2,community\n\nE1,2021-01-01,B,B.\n"), 1)
+	assert.EqualError(t, err, "line 3: expected 7 columns, got 4")
+}
+
+func testAdminOpts() adminOpts {
+	db := covince.CreateDatabase()
+	db.Columns = []string{"sampleType"}
+	store := covince.CreateColumnStore(db)
+	for i, clade := range []string{"B.", "B.1.", "A."} {
+		store.Append(&covince.Record{
+			Metadata:   db.IndexMetadata([]string{"community"}),
+			Area:       db.IndexValue("E1"),
+			Date:       db.IndexValue("2021-01-01"),
+			PangoClade: db.IndexValue(clade),
+			Mutations:  db.IndexMutations([]string{"S:D614G"}, ":"),
+			Count:      i + 1,
+		})
+	}
+	store.Partition()
+	planner := &covince.Planner{Store: store, Threads: 1}
+	planner.IndexWithin(0)
+	return adminOpts{
+		Dataset: covince.CreateDataset(planner, 1000),
+		Cache:   api.NewResultCache(1024),
+		Columns: 1,
+		Token:   "secret",
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	opts := testAdminOpts()
+	handler := admin(opts)
+	request := func(method string, path string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		handler(rw, r)
+		return rw
+	}
+
+	before := opts.Dataset.Current()
+	for _, c := range []struct {
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"GET", "/admin/memory", "", "", http.StatusUnauthorized},
+		{"GET", "/admin/memory", "wrong", "", http.StatusUnauthorized},
+		{"POST", "/admin/delta", "secre", "", http.StatusUnauthorized},
+		{"GET", "/admin/memory", "secret", "", http.StatusOK},
+		{"GET", "/admin/cache", "secret", "", http.StatusOK},
+		{"GET", "/admin/delta", "secret", "", http.StatusMethodNotAllowed},
+		{"POST", "/admin/memory", "secret", "", http.StatusMethodNotAllowed},
+		{"POST", "/admin/cache", "secret", "", http.StatusMethodNotAllowed},
+		{"GET", "/admin/unknown", "secret", "", http.StatusNotFound},
+		{"POST", "/admin/delta", "secret", "E1,2021-01-01,B,B.,,x,community", http.StatusBadRequest},
+		{"POST", "/admin/delta", "secret", "E1,2021-01-01,B,B.,S,1,community", http.StatusBadRequest},
+		{"POST", "/admin/delta", "secret", "", http.StatusOK},
+	} {
+		rw := request(c.method, c.path, c.token, c.body)
+		assert.Equal(t, c.status, rw.Code, c.method+" "+c.path)
+		assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	}
+	assert.Same(t, before, opts.Dataset.Current())
+
+	t.Run("a delta over the memory limit", func(t *testing.T) {
+		opts.Dataset.Limit = 1
+		defer func() { opts.Dataset.Limit = 0 }()
+		rw := request("POST", "/admin/delta", "secret", "E2,2021-01-02,C,C.,,4,community")
+		assert.Equal(t, http.StatusInsufficientStorage, rw.Code)
+		assert.Contains(t, rw.Body.String(), "memory limit exceeded")
+		assert.Equal(t, int64(1000), opts.Dataset.Current().LastModified)
+	})
+
+	t.Run("a delta changes the info", func(t *testing.T) {
+		handler := api.CovinceAPI(api.Opts{MaxLineages: 16, Dataset: opts.Dataset, Threads: 1, MetadataColumns: []string{"sampleType"}}, nil)
+		var info struct {
+			LastModified int64    `json:"lastModified"`
+			Dates        []string `json:"dates"`
+			Areas        []string `json:"areas"`
+		}
+		getInfo := func() {
+			rw := httptest.NewRecorder()
+			handler(rw, httptest.NewRequest("GET", "/info", nil))
+			assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &info))
+		}
+		getInfo()
+		assert.Equal(t, []string{"E1"}, info.Areas)
+
+		rw := request("POST", "/admin/delta", "secret", "E2,2021-01-02,C,C.,S:N501Y,4,community\nE1,2021-01-01,B,B.,S:D614G,-,community\n")
+		assert.Equal(t, http.StatusOK, rw.Code)
+		var result covince.UpsertResult
+		assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &result))
+		assert.Equal(t, 1, result.Inserted)
+		assert.Equal(t, 1, result.Deleted)
+		assert.Equal(t, 3, result.Records)
+
+		assert.Eventually(t, func() bool {
+			getInfo()
+			return info.LastModified == result.LastModified
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, []string{"E1", "E2"}, info.Areas)
+		assert.Equal(t, []string{"2021-01-01", "2021-01-02"}, info.Dates)
+	})
+
+	t.Run("a body over the size limit", func(t *testing.T) {
+		rw := request("POST", "/admin/delta", "secret", strings.Repeat("\n", MAX_DELTA_BYTES+1))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+}
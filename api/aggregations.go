@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"net/url"
+
+	"github.com/covince/covince-backend-v2/covince"
+)
+
+// aggregation is an endpoint that can be computed from a single pass over
+// the records, which allows several to share a scan. Each slice of the scan
+// aggregates into its own partial, and the merged partial gives the result.
+type aggregation struct {
+	newPartial func() covince.Partial
+	result     func(p covince.Partial) interface{}
+	// the filters that every contributing record matches, used to narrow
+	// the scan, or nil if every record contributes
+	selection *covince.Query
+	// can be answered by the cube instead of the records
+	cubeable bool
+}
+
+func (a *aggregation) run(ctx context.Context, scan covince.ContextIteratorFunc, threads int) (interface{}, error) {
+	p, err := covince.MapReduce(ctx, scan, threads, a.newPartial)
+	if err != nil {
+		return nil, err
+	}
+	return a.result(p), nil
+}
+
+// fromCube reports whether the cube can answer the query, which it can when
+// neither mutations nor metadata are involved.
+func fromCube(q *covince.Query, qs url.Values) bool {
+	if len(q.Metadata) > 0 {
+		return false
+	}
+	if breakdown := qs.Get("breakdown"); breakdown != "" && breakdown != "area" {
+		return false
+	}
+	for _, lineages := range [][]covince.QueryLineage{q.Lineages, q.Excluding} {
+		for _, ql := range lineages {
+			if len(ql.Mutations) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// withoutLineages is the selection of an aggregation that counts every
+// lineage.
+func withoutLineages(q *covince.Query) *covince.Query {
+	selection := *q
+	selection.Lineages = nil
+	return &selection
+}
+
+func newAggregation(endpoint string, qs url.Values, q *covince.Query, opts *Opts, sequenced covince.Index) (*aggregation, error) {
+	switch endpoint {
+	case "/frequency":
+		breakdown, err := parseBreakdown(qs, opts)
+		if err != nil {
+			return nil, err
+		}
+		if breakdown != nil {
+			return &aggregation{
+				newPartial: func() covince.Partial {
+					return covince.NewGroupedIndexPartial(func(m map[string]covince.Index, r *covince.Record) {
+						covince.FrequencyBy(m, q, breakdown, r)
+					})
+				},
+				result: func(p covince.Partial) interface{} {
+					m := p.(*covince.GroupedIndexPartial).Groups
+					if opts.MutSuppressionMin > 0 {
+						for _, i := range m {
+							covince.SuppressMutations(i, opts.MutSuppressionMin)
+						}
+					}
+					return m
+				},
+				selection: q,
+				cubeable:  fromCube(q, qs),
+			}, nil
+		}
+		return &aggregation{
+			newPartial: func() covince.Partial {
+				return covince.NewIndexPartial(func(i covince.Index, r *covince.Record) {
+					covince.Frequency(i, q, r)
+				})
+			},
+			result: func(p covince.Partial) interface{} {
+				i := p.(*covince.IndexPartial).Index
+				if opts.MutSuppressionMin > 0 {
+					covince.SuppressMutations(i, opts.MutSuppressionMin)
+				}
+				return i
+			},
+			selection: q,
+			cubeable:  fromCube(q, qs),
+		}, nil
+
+	case "/spatiotemporal/total":
+		so, err := parseSpatiotemporalOptions(qs, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &aggregation{
+			newPartial: func() covince.Partial {
+				return covince.NewGroupedIndexPartial(func(m map[string]covince.Index, r *covince.Record) {
+					covince.TotalsByLineage(m, q, r)
+				})
+			},
+			result: func(p covince.Partial) interface{} {
+				perLineage := p.(*covince.GroupedIndexPartial).Groups
+				i := covince.SumTotals(perLineage, q, opts.MutSuppressionMin)
+				return spatiotemporalResponse(i, opts, sequenced, so, q)
+			},
+			selection: &covince.Query{Lineages: q.Lineages},
+			cubeable:  fromCube(q, qs),
+		}, nil
+
+	case "/spatiotemporal/lineage":
+		if len(q.Lineages) != 1 {
+			return nil, invalidParameter("lineages", "exactly one lineage required")
+		}
+		so, err := parseSpatiotemporalOptions(qs, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &aggregation{
+			newPartial: func() covince.Partial {
+				return covince.NewIndexPartial(func(i covince.Index, r *covince.Record) {
+					covince.Spatiotemporal(i, q, r)
+				})
+			},
+			result: func(p covince.Partial) interface{} {
+				i := p.(*covince.IndexPartial).Index
+				if opts.MutSuppressionMin > 0 && len(q.Lineages[0].Mutations) > 0 {
+					covince.Suppress(i, opts.MutSuppressionMin)
+				}
+				return spatiotemporalResponse(i, opts, sequenced, so, q)
+			},
+			selection: &covince.Query{Lineages: q.Lineages},
+			cubeable:  fromCube(q, qs),
+		}, nil
+
+	case "/lineages":
+		breakdown, err := parseBreakdown(qs, opts)
+		if err != nil {
+			return nil, err
+		}
+		if breakdown != nil {
+			return &aggregation{
+				newPartial: func() covince.Partial {
+					return covince.NewGroupedCountsPartial(func(m map[string]map[string]int, r *covince.Record) {
+						covince.LineagesBy(m, q, breakdown, r)
+					})
+				},
+				result: func(p covince.Partial) interface{} {
+					return p.(*covince.GroupedCountsPartial).Groups
+				},
+				selection: withoutLineages(q),
+				cubeable:  fromCube(q, qs),
+			}, nil
+		}
+		return &aggregation{
+			newPartial: func() covince.Partial {
+				return covince.NewCountsPartial(func(m map[string]int, r *covince.Record) {
+					covince.Lineages(m, q, r)
+				})
+			},
+			result: func(p covince.Partial) interface{} {
+				return p.(*covince.CountsPartial).Counts
+			},
+			selection: withoutLineages(q),
+			cubeable:  fromCube(q, qs),
+		}, nil
+
+	case "/aggregate":
+		groups, err := parseGroupBy(qs, q, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &aggregation{
+			newPartial: func() covince.Partial {
+				return covince.NewAggregatePartial(func(i covince.AggregateIndex, r *covince.Record) {
+					covince.Aggregate(i, q, groups, r)
+				})
+			},
+			result: func(p covince.Partial) interface{} {
+				i := p.(*covince.AggregatePartial).Index
+				if opts.MutSuppressionMin > 0 && hasMutations(q, groups) {
+					i.Suppress(opts.MutSuppressionMin)
+				}
+				return i.Table(groups)
+			},
+			selection: q,
+		}, nil
+	}
+	return nil, nil
+}
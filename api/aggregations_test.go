@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThreads(t *testing.T) {
+	var records []covince.Record
+	for i, clade := range []string{"B.1.", "B.1.1.", "A.", "B.", "A.2."} {
+		for j, date := range []string{"2021-01-01", "2021-01-02", "2021-01-08"} {
+			records = append(records, covince.Record{
+				PangoClade: &covince.Value{Value: clade},
+				Date:       &covince.Value{Value: date},
+				Area:       &covince.Value{Value: []string{"E1", "E2"}[(i+j)%2]},
+				Count:      i + j + 1,
+			})
+		}
+	}
+	scan := func(threads int) covince.ContextIteratorFunc {
+		return func(ctx context.Context, agg func(r *covince.Record), sliceIndex int) error {
+			from, to := covince.SliceBounds(len(records), sliceIndex, threads)
+			return covince.IterateRecords(ctx, records[from:to], agg)
+		}
+	}
+	serial := CovinceAPI(Opts{MaxLineages: 16}, scan(1))
+	parallel := CovinceAPI(Opts{MaxLineages: 16, Threads: 4}, scan(4))
+
+	for _, url := range []string{
+		"/info",
+		"/frequency?lineages=B.1,A",
+		"/frequency?lineages=B,A&breakdown=area",
+		"/spatiotemporal/total?lineages=B.1,A",
+		"/spatiotemporal/lineage?lineages=B",
+		"/lineages",
+		"/lineages?breakdown=area",
+		"/aggregate?groupBy=date:week,area,lineage&lineages=B,A",
+		"/emerging?lineages=B&from=2021-01-08&to=2021-01-08&baselineFrom=2021-01-01&baselineTo=2021-01-02",
+	} {
+		expected := httptest.NewRecorder()
+		serial(expected, httptest.NewRequest("GET", url, nil))
+		actual := httptest.NewRecorder()
+		parallel(actual, httptest.NewRequest("GET", url, nil))
+		assert.Equal(t, http.StatusOK, actual.Code, url)
+		assert.Equal(t, expected.Body.String(), actual.Body.String(), url)
+	}
+}
+
+// strategy returns the plan that the handler explains for the url.
+func strategy(t *testing.T, handler http.HandlerFunc, url string) string {
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", url+"&explain=true", nil))
+	assert.Equal(t, http.StatusOK, rw.Code, url)
+	var e struct {
+		Plan covince.Plan `json:"plan"`
+	}
+	assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &e), url)
+	return e.Plan.Strategy
+}
+
+func TestSelectScan(t *testing.T) {
+	planner := testPlanner()
+	handler := CovinceAPI(Opts{MaxLineages: 16, Genes: map[string]bool{"S": true}, Planner: planner, Threads: 2}, planner.Store.Scan(2))
+
+	for url, expected := range map[string]int{
+		"/frequency?lineages=B%2BS:N501Y":              1,
+		"/frequency?lineages=B%2BS:N501Y,B":            0,
+		"/lineages?lineages=B%2BS:N501Y":               0,
+		"/aggregate?groupBy=area&lineages=B%2BS:N501Y": 1,
+		"/aggregate?groupBy=area":                      0,
+	} {
+		selected := 0
+		if strategy(t, handler, url) == covince.PLAN_INDEX {
+			selected = 1
+		}
+		assert.Equal(t, expected, selected, url)
+	}
+}
+
+func TestCube(t *testing.T) {
+	planner := testPlanner()
+	handler := CovinceAPI(Opts{MaxLineages: 16, Genes: map[string]bool{"S": true}, Planner: planner, Threads: 2}, planner.Store.Scan(2))
+
+	for url, expected := range map[string]int{
+		"/frequency?lineages=B,A":                  1,
+		"/frequency?lineages=B%2BS:N501Y":          0,
+		"/spatiotemporal/total?lineages=B&area=E1": 1,
+		"/spatiotemporal/lineage?lineages=B":       1,
+		"/lineages?breakdown=area":                 1,
+		"/aggregate?groupBy=area":                  0,
+	} {
+		cubeScans := 0
+		if strategy(t, handler, url) == covince.PLAN_CUBE {
+			cubeScans = 1
+		}
+		assert.Equal(t, expected, cubeScans, url)
+	}
+}
+
+func testPlanner() *covince.Planner {
+	db := covince.CreateDatabase()
+	store := covince.CreateColumnStore(db)
+	for i := 0; i < 400; i++ {
+		muts := []string{"S:D614G"}
+		if i%10 == 0 {
+			muts = append(muts, "S:N501Y")
+		}
+		store.Append(&covince.Record{
+			Date:       db.IndexValue(fmt.Sprintf("2021-01-%02d", i%20+1)),
+			Area:       db.IndexValue(fmt.Sprintf("E%v", i%7)),
+			PangoClade: db.IndexValue([]string{"B.1.", "B.1.1.7.", "A.", "B.", "A.2.", "B.2.", "C."}[i%7]),
+			Mutations:  db.IndexMutations(muts, ":"),
+			Count:      i%3 + 1,
+		})
+	}
+	store.Partition()
+	return &covince.Planner{
+		Store:     store,
+		Mutations: covince.CreateMutationIndex(store),
+		Clades:    covince.CreateCladeIndex(store),
+		Cube:      store.Cube(),
+		Threads:   2,
+	}
+}
+
+func TestPlanner(t *testing.T) {
+	planner := testPlanner()
+	scan := planner.Store.Scan(1)
+	unplanned := CovinceAPI(Opts{MaxLineages: 16, Genes: map[string]bool{"S": true}}, scan)
+	handler := CovinceAPI(Opts{MaxLineages: 16, Genes: map[string]bool{"S": true}, Planner: planner}, nil)
+
+	for path, strategy := range map[string]string{
+		"/frequency?lineages=B,A":                           covince.PLAN_CUBE,
+		"/frequency?lineages=B%2BS:N501Y":                   covince.PLAN_INDEX,
+		"/frequency?lineages=B%2BS:N501Y,B":                 covince.PLAN_SCAN,
+		"/frequency?lineages=B%2BS:N501Y,B&from=2021-01-19": covince.PLAN_PARTITIONS,
+		"/spatiotemporal/lineage?lineages=C":                covince.PLAN_CUBE,
+		"/lineages?breakdown=area&area=E1":                  covince.PLAN_CUBE,
+		"/aggregate?groupBy=area&lineages=C":                covince.PLAN_INDEX,
+		"/mutations?lineages=B&parent=B":                    covince.PLAN_SCAN,
+	} {
+		expected := httptest.NewRecorder()
+		unplanned(expected, httptest.NewRequest("GET", path, nil))
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("GET", path+"&explain=true", nil))
+		assert.Equal(t, http.StatusOK, rw.Code, path)
+
+		var e struct {
+			Plan   covince.Plan    `json:"plan"`
+			Result json.RawMessage `json:"result"`
+		}
+		assert.Nil(t, json.Unmarshal(rw.Body.Bytes(), &e))
+		assert.Equal(t, strategy, e.Plan.Strategy, path)
+		assert.Equal(t, int64(e.Plan.EstimatedRows), e.Plan.RowsScanned, path)
+		assert.JSONEq(t, expected.Body.String(), string(e.Result), path)
+	}
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", "/lineages?explain=yes", nil))
+	assert.Equal(t, http.StatusBadRequest, rw.Code)
+
+	t.Run("threads are taken from the planner", func(t *testing.T) {
+		mismatched := CovinceAPI(Opts{MaxLineages: 16, Genes: map[string]bool{"S": true}, Planner: planner, Threads: 3}, scan)
+		for _, path := range []string{
+			"/info",
+			"/spatiotemporal/lineage?lineages=C&normalise=sequenced",
+			"/mutations?lineages=B&parent=B",
+		} {
+			expected := httptest.NewRecorder()
+			unplanned(expected, httptest.NewRequest("GET", path, nil))
+			rw := httptest.NewRecorder()
+			mismatched(rw, httptest.NewRequest("GET", path, nil))
+			assert.JSONEq(t, expected.Body.String(), rw.Body.String(), path)
+		}
+	})
+}
+
+func TestDataset(t *testing.T) {
+	dataset := covince.CreateDataset(testPlanner(), 1000)
+	handler := CovinceAPI(Opts{MaxLineages: 16, CacheBudget: 1024 * 1024, Dataset: dataset, Threads: 2}, nil)
+	get := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+	var info struct {
+		LastModified int64    `json:"lastModified"`
+		Dates        []string `json:"dates"`
+		Genes        []string `json:"genes"`
+	}
+	// the previous version is served until the new one has been derived
+	waitFor := func(lastModified int64) {
+		assert.Eventually(t, func() bool {
+			json.Unmarshal(get("/info").Body.Bytes(), &info)
+			return info.LastModified == lastModified
+		}, time.Second, time.Millisecond)
+	}
+
+	path := "/aggregate?groupBy=date&lineages=D%2BORF8:Q27*"
+	assert.Equal(t, http.StatusBadRequest, get(path).Code)
+	before := get("/aggregate?groupBy=date")
+	assert.Nil(t, json.Unmarshal(get("/info").Body.Bytes(), &info))
+	assert.Equal(t, int64(1000), info.LastModified)
+	assert.Equal(t, []string{"S"}, info.Genes)
+
+	_, err := dataset.Upsert([]covince.Row{
+		{Area: "E1", Date: "2021-02-01", PangoClade: "D.", Mutations: []string{"ORF8:Q27*"}, Count: 5},
+	}, ":", 2000)
+	assert.Nil(t, err)
+	waitFor(2000)
+
+	after := get("/aggregate?groupBy=date")
+	assert.NotEqual(t, before.Header().Get("ETag"), after.Header().Get("ETag"))
+	assert.NotEqual(t, before.Body.String(), after.Body.String())
+	assert.JSONEq(t, `{"columns":["date","count"],"rows":[["2021-02-01",5]]}`, get(path).Body.String())
+	assert.Nil(t, json.Unmarshal(get("/info").Body.Bytes(), &info))
+	assert.Equal(t, int64(2000), info.LastModified)
+	assert.Equal(t, "2021-02-01", info.Dates[len(info.Dates)-1])
+	assert.ElementsMatch(t, []string{"S", "ORF8"}, info.Genes)
+
+	_, err = dataset.Upsert([]covince.Row{
+		{Area: "E1", Date: "2021-02-01", PangoClade: "D.", Mutations: []string{"ORF8:Q27*"}, Deleted: true},
+	}, ":", 3000)
+	assert.Nil(t, err)
+	waitFor(3000)
+	assert.Equal(t, before.Body.String(), get("/aggregate?groupBy=date").Body.String())
+	assert.JSONEq(t, `{"columns":["date","count"],"rows":[]}`, get(path).Body.String())
+	assert.Nil(t, json.Unmarshal(get("/info").Body.Bytes(), &info))
+	assert.NotContains(t, info.Dates, "2021-02-01")
+}
+
+func TestSnapshots(t *testing.T) {
+	planner := testPlanner()
+	var scans int64
+	planner.Instrument = func(scan covince.ContextIteratorFunc) covince.ContextIteratorFunc {
+		atomic.AddInt64(&scans, 1)
+		return scan
+	}
+	dataset := covince.CreateDataset(planner, 1000)
+	handler := CovinceAPI(Opts{MaxLineages: 16, Dataset: dataset, Threads: 2}, nil)
+	lastModified := func() int64 {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("GET", "/info", nil))
+		var info struct {
+			LastModified int64 `json:"lastModified"`
+		}
+		json.Unmarshal(rw.Body.Bytes(), &info)
+		return info.LastModified
+	}
+
+	atomic.StoreInt64(&scans, 0)
+	_, err := dataset.Upsert([]covince.Row{{Area: "E1", Date: "2021-02-01", PangoClade: "D.", Count: 5}}, ":", 2000)
+	assert.Nil(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				// never an older version once the new one is served
+				if lastModified() == 2000 {
+					assert.Equal(t, int64(2000), lastModified())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Eventually(t, func() bool { return lastModified() == 2000 }, time.Second, time.Millisecond)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&scans))
+}
@@ -1,9 +1,16 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/covince/covince-backend-v2/covince"
@@ -11,26 +18,55 @@ import (
 )
 
 type Opts struct {
+	AreaHierarchy     *covince.AreaHierarchy
+	Boundaries        Boundaries
+	Cache             *ResultCache
+	Dataset           *covince.Dataset
+	EndpointTimeouts  map[string]time.Duration
+	CacheBudget       int
+	CacheMaxAge       int
 	Genes             map[string]bool
 	LastModified      int64
 	MaxLineages       int
 	MaxSearchResults  int
+	MetadataColumns   []string
 	MultipleMuts      bool
 	MutSuppressionMin int
 	MutSeparator      string
 	PathPrefix        string
+	Planner           *covince.Planner
+	Timeout           time.Duration
+	Population        covince.Population
 	Threads           int
 }
 
-func getInfo(opts *Opts, foreach covince.IteratorFunc) map[string]interface{} {
+func getInfo(opts *Opts, scan covince.ContextIteratorFunc) map[string]interface{} {
 	m := make(map[string]interface{})
 
 	m["lastModified"] = opts.LastModified
 	m["maxLineages"] = opts.MaxLineages
 
-	dates, areas := covince.Info(foreach)
-	m["dates"] = dates
-	m["areas"] = areas
+	dimensions := map[string]covince.Dimension{
+		"dates": covince.DateDimension,
+		"areas": covince.AreaDimension,
+	}
+	for i, c := range opts.MetadataColumns {
+		dimensions["metadata:"+c] = covince.MetadataDimension(i)
+	}
+	distinct, _ := covince.DistinctValuesBy(context.Background(), scan, opts.Threads, dimensions)
+	m["dates"] = distinct["dates"]
+	m["areas"] = distinct["areas"]
+	if opts.AreaHierarchy != nil {
+		m["areaLevels"] = opts.AreaHierarchy.Levels
+	}
+	m["population"] = opts.Population != nil
+	m["geojson"] = opts.Boundaries != nil
+
+	metadata := make(map[string][]string)
+	for _, c := range opts.MetadataColumns {
+		metadata[c] = distinct["metadata:"+c]
+	}
+	m["metadata"] = metadata
 
 	uniqueGenes := make([]string, len(opts.Genes))
 	i := 0
@@ -43,75 +79,325 @@ func getInfo(opts *Opts, foreach covince.IteratorFunc) map[string]interface{} {
 	return m
 }
 
-func CovinceAPI(opts Opts, foreach covince.IteratorFunc) http.HandlerFunc {
-	cachedInfo := getInfo(&opts, foreach)
+func normalise(i covince.Index, opts *Opts, sequenced covince.Index, so *spatiotemporalOpts) covince.RateIndex {
+	var population covince.Population
+	if so.ByPopulation {
+		population = opts.Population
+		if so.AreaLevel != "" {
+			population = opts.AreaHierarchy.RollUpPopulation(population, so.AreaLevel)
+		}
+	}
+	if !so.BySequenced {
+		sequenced = nil
+	} else if so.AreaLevel != "" {
+		sequenced = opts.AreaHierarchy.RollUp(sequenced, so.AreaLevel)
+	}
+	return covince.Normalise(i, population, sequenced)
+}
 
-	return func(rw http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		log.Println("Handle request")
+func spatiotemporalResponse(i covince.Index, opts *Opts, sequenced covince.Index, so *spatiotemporalOpts, q *covince.Query) interface{} {
+	if so.AreaLevel != "" {
+		i = opts.AreaHierarchy.RollUp(i, so.AreaLevel)
+	}
+	if so.GeoJSON {
+		return geoJSON(i, opts, sequenced, so, q)
+	}
+	if so.ByPopulation || so.BySequenced {
+		return normalise(i, opts, sequenced, so)
+	}
+	return i
+}
 
-		if r.Method != "GET" {
-			rw.WriteHeader(http.StatusMethodNotAllowed)
-			return
+func hasMutations(q *covince.Query, groups []covince.GroupBy) bool {
+	for _, g := range groups {
+		if g.Kind == covince.GROUP_BY_MUTATION || g.Kind == covince.GROUP_BY_GENE {
+			return true
+		}
+	}
+	for _, ql := range q.Lineages {
+		if len(ql.Mutations) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+var endpoints = map[string]bool{
+	"/info":                   true,
+	"/frequency":              true,
+	"/spatiotemporal/total":   true,
+	"/spatiotemporal/lineage": true,
+	"/lineages":               true,
+	"/aggregate":              true,
+	"/mutations":              true,
+	"/emerging":               true,
+	"/batch":                  true,
+}
+
+func encodeResponse(response interface{}) (string, []byte) {
+	contentType := "application/json"
+	if _, ok := response.(*FeatureCollection); ok {
+		contentType = "application/geo+json"
+	}
+	var buf bytes.Buffer
+	json.NewEncoder(&buf).Encode(response)
+	return contentType, buf.Bytes()
+}
+
+func writeBody(rw http.ResponseWriter, contentType string, body []byte) {
+	rw.Header().Set("Content-Type", contentType)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
+
+func (opts *Opts) timeout(endpoint string) time.Duration {
+	if t, ok := opts.EndpointTimeouts[endpoint]; ok {
+		return t
+	}
+	return opts.Timeout
+}
+
+// plan finds the records that can match the selection, falling back to the
+// whole scan without a planner.
+func (opts *Opts) plan(scan covince.ContextIteratorFunc, selection *covince.Query, cubeable bool) *covince.Plan {
+	if opts.Planner == nil {
+		return covince.ScanPlan(scan)
+	}
+	return opts.Planner.Plan(selection, cubeable)
+}
+
+type explained struct {
+	Plan   *covince.Plan `json:"plan"`
+	Result interface{}   `json:"result"`
+}
+
+// snapshot is what the handler derives from one version of the data.
+type snapshot struct {
+	version   *covince.Version
+	opts      Opts
+	scan      covince.ContextIteratorFunc
+	info      map[string]interface{}
+	sequenced covince.Index
+}
+
+// newSnapshot derives a snapshot of scan or, with a planner, of its store.
+// The planner slices every plan by its own thread count, which then
+// replaces opts.Threads so that each record is aggregated once.
+func newSnapshot(opts Opts, scan covince.ContextIteratorFunc) *snapshot {
+	if opts.Planner != nil {
+		opts.Threads = opts.Planner.Threads
+		scan = opts.Planner.Plan(nil, false).Scan
+	}
+	p, _ := covince.MapReduce(context.Background(), scan, opts.Threads, func() covince.Partial {
+		return covince.NewIndexPartial(covince.Sequenced)
+	})
+	return &snapshot{
+		opts:      opts,
+		scan:      scan,
+		info:      getInfo(&opts, scan),
+		sequenced: p.(*covince.IndexPartial).Index,
+	}
+}
+
+func versionSnapshot(opts Opts, v *covince.Version) *snapshot {
+	opts.LastModified = v.LastModified
+	opts.Planner = v.Planner
+	opts.Genes = v.Planner.Store.Database().Genes
+	snap := newSnapshot(opts, nil)
+	snap.version = v
+	return snap
+}
+
+// CovinceAPI serves queries of the records iterated by scan, which is split
+// into opts.Threads slices. A Planner replaces scan and Threads, and if
+// opts.Dataset is set, its current version replaces scan, Planner, Genes and
+// LastModified. Responses are cached in opts.Cache or, if it is
+// nil, a cache of opts.CacheBudget bytes.
+func CovinceAPI(opts Opts, scan covince.ContextIteratorFunc) http.HandlerFunc {
+	cache := opts.Cache
+	if cache == nil {
+		cache = NewResultCache(opts.CacheBudget)
+	}
+	inflight := newCoalescer()
+
+	var current atomic.Value
+	if opts.Dataset == nil {
+		current.Store(newSnapshot(opts, scan))
+	} else {
+		current.Store(versionSnapshot(opts, opts.Dataset.Current()))
+	}
+	var mu sync.Mutex
+	var building *covince.Version
+	// latest serves the snapshot of the previous version while that of a new
+	// one is derived in the background, once per version
+	latest := func() *snapshot {
+		snap := current.Load().(*snapshot)
+		if opts.Dataset == nil {
+			return snap
 		}
-		qs := r.URL.Query()
-		q, err := parseQuery(qs, &opts)
+		v := opts.Dataset.Current()
+		if v == snap.version {
+			return snap
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if v != building {
+			building = v
+			go func() {
+				next := versionSnapshot(opts, v)
+				mu.Lock()
+				defer mu.Unlock()
+				// a later version may have been derived first
+				if next.opts.LastModified > current.Load().(*snapshot).opts.LastModified {
+					current.Store(next)
+				}
+			}()
+		}
+		return snap
+	}
+
+	compute := func(ctx context.Context, snap *snapshot, endpoint string, qs url.Values, q *covince.Query) (interface{}, error) {
+		opts, scan := &snap.opts, snap.scan
+		if endpoint == "/info" {
+			return snap.info, nil
+		}
+
+		explain, err := parseExplain(qs)
 		if err != nil {
-			http.Error(rw, err.Error(), http.StatusBadRequest)
-			return
+			return nil, err
+		}
+		withPlan := func(plan *covince.Plan, result interface{}, err error) (interface{}, error) {
+			if err != nil || !explain {
+				return result, err
+			}
+			return &explained{Plan: plan, Result: result}, nil
 		}
 
-		var response interface{}
+		a, err := newAggregation(endpoint, qs, q, opts, snap.sequenced)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			plan := opts.plan(scan, a.selection, a.cubeable)
+			result, err := a.run(ctx, plan.Scan, opts.Threads)
+			return withPlan(plan, result, err)
+		}
 
-		if r.URL.Path == opts.PathPrefix+"/info" {
-			response = cachedInfo
+		if endpoint == "/mutations" {
+			searchOpts := parseSearchOptions(qs, opts.MaxSearchResults)
+			searchOpts.SuppressionMin = opts.MutSuppressionMin
+			searchOpts.Threads = opts.Threads
+			plan := opts.plan(scan, q, false)
+			result, err := covince.SearchMutationsContext(ctx, plan.Scan, q, searchOpts)
+			return withPlan(plan, result, err)
 		}
-		if r.URL.Path == opts.PathPrefix+"/frequency" {
-			i := make(covince.Index)
-			foreach(func(r *covince.Record) {
-				covince.Frequency(i, q, r)
-			}, -1)
-			if opts.MutSuppressionMin > 0 {
-				covince.SuppressMutations(i, opts.MutSuppressionMin)
+
+		if endpoint == "/emerging" {
+			emergingOpts, err := parseEmergingOptions(qs, q, opts)
+			if err != nil {
+				return nil, err
 			}
-			response = i
+			return covince.EmergingSearchContext(ctx, scan, opts.Threads, q, emergingOpts)
 		}
-		if r.URL.Path == opts.PathPrefix+"/spatiotemporal/total" {
-			i := covince.Totals(foreach, q, opts.MutSuppressionMin)
-			response = i
+
+		return nil, errNotFound
+	}
+
+	// respond serves from the cache, or shares a computation with any
+	// identical requests of the same version already in flight
+	respond := func(rw http.ResponseWriter, r *http.Request, lastModified int64, endpoint string, key string, fn func(ctx context.Context) (interface{}, error)) {
+		if cached, ok := cache.get(lastModified, key); ok {
+			writeBody(rw, cached.contentType, cached.body)
+			return
 		}
-		if r.URL.Path == opts.PathPrefix+"/spatiotemporal/lineage" {
-			if len(q.Lineages) != 1 {
-				rw.WriteHeader(http.StatusBadRequest)
+		contentType, body, err := inflight.do(r.Context(), strconv.FormatInt(lastModified, 10)+" "+key, func(ctx context.Context) (string, []byte, error) {
+			if timeout := opts.timeout(endpoint); timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			response, err := fn(ctx)
+			if err != nil {
+				return "", nil, err
+			}
+			contentType, body := encodeResponse(response)
+			cache.put(lastModified, key, contentType, body)
+			return contentType, body, nil
+		})
+		if err != nil {
+			if r.Context().Err() == nil {
+				writeError(rw, err)
+			}
+			return
+		}
+		writeBody(rw, contentType, body)
+	}
+
+	return func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		log.Println("Handle request")
+
+		endpoint := strings.TrimPrefix(r.URL.Path, opts.PathPrefix)
+		if !endpoints[endpoint] {
+			writeError(rw, errNotFound)
+			return
+		}
+
+		snap := latest()
+		opts := &snap.opts
+
+		if endpoint == "/batch" {
+			if r.Method != "POST" {
+				writeError(rw, errMethodNotAllowed)
+				return
+			}
+			br, err := parseBatch(r.Body, opts, snap.sequenced)
+			if err != nil {
+				writeError(rw, err)
 				return
 			}
-			i := make(covince.Index)
-			foreach(func(r *covince.Record) {
-				covince.Spatiotemporal(i, q, r)
-			}, -1)
-			if opts.MutSuppressionMin > 0 && len(q.Lineages[0].Mutations) > 0 {
-				covince.Suppress(i, opts.MutSuppressionMin)
+			setCacheHeaders(rw, opts, etag(opts.LastModified, br.Key))
+			respond(rw, r, opts.LastModified, endpoint, br.Key, func(ctx context.Context) (interface{}, error) {
+				plan := opts.plan(snap.scan, &covince.Query{}, br.cubeable())
+				return batch(ctx, plan.Scan, opts.Threads, br.Aggregations)
+			})
+			perf.LogDuration(r.URL.Path, start)
+			return
+		}
+
+		var qs url.Values
+		if r.Method == "GET" {
+			qs = r.URL.Query()
+		} else if r.Method == "POST" {
+			var err error
+			qs, err = parseBody(r.Body, opts)
+			if err != nil {
+				writeError(rw, err)
+				return
 			}
-			response = i
+		} else {
+			writeError(rw, errMethodNotAllowed)
+			return
 		}
-		if r.URL.Path == opts.PathPrefix+"/lineages" {
-			m := make(map[string]int)
-			foreach(func(r *covince.Record) {
-				covince.Lineages(m, q, r)
-			}, -1)
-			response = m
+		q, err := parseQuery(qs, opts)
+		if err != nil {
+			writeError(rw, err)
+			return
 		}
 
-		if r.URL.Path == opts.PathPrefix+"/mutations" {
-			searchOpts := parseSearchOptions(qs, opts.MaxSearchResults)
-			searchOpts.SuppressionMin = opts.MutSuppressionMin
-			searchOpts.Threads = opts.Threads
-			response = covince.SearchMutations(foreach, q, searchOpts)
+		key := canonicalQuery(endpoint, qs, opts)
+		tag := etag(opts.LastModified, key)
+		if notModified(r, opts, tag) {
+			setCacheHeaders(rw, opts, tag)
+			rw.WriteHeader(http.StatusNotModified)
+			return
 		}
 
-		rw.Header().Set("Content-Type", "application/json")
-		rw.WriteHeader(http.StatusOK)
-		json.NewEncoder(rw).Encode(response)
+		// set before the body is written, and removed again on error
+		setCacheHeaders(rw, opts, tag)
+		respond(rw, r, opts.LastModified, endpoint, key, func(ctx context.Context) (interface{}, error) {
+			return compute(ctx, snap, endpoint, qs, q)
+		})
 
 		perf.LogMemory()
 		perf.LogDuration(r.URL.Path, start)
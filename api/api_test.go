@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net/url"
 	"testing"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestParseQuery(t *testing.T) {
@@ -52,3 +55,216 @@ func TestMultipleMuts(t *testing.T) {
 		}
 	})
 }
+
+func TestParseEmergingOptions(t *testing.T) {
+	opts := Opts{MutSuppressionMin: 5}
+
+	t.Run("requires baseline", func(t *testing.T) {
+		_, err := parseEmergingOptions(url.Values{}, &covince.Query{}, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+	t.Run("min count cannot go below suppression", func(t *testing.T) {
+		qs := url.Values{"baselineTo": {"2021-01-01"}, "minCount": {"1"}}
+		eo, err := parseEmergingOptions(qs, &covince.Query{}, &opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if eo.MinCount != 5 {
+			t.Errorf("expected min count 5, got %v", eo.MinCount)
+		}
+		if eo.SuppressionMin != 5 {
+			t.Errorf("expected suppression min 5, got %v", eo.SuppressionMin)
+		}
+	})
+	t.Run("rejects invalid threshold", func(t *testing.T) {
+		qs := url.Values{"baselineTo": {"2021-01-01"}, "threshold": {"-1"}}
+		_, err := parseEmergingOptions(qs, &covince.Query{}, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+	t.Run("recent window starts after the baseline by default", func(t *testing.T) {
+		q := covince.Query{}
+		_, err := parseEmergingOptions(url.Values{"baselineFrom": {"2021-01-01"}, "baselineTo": {"2021-01-31"}}, &q, &opts)
+		assert.Nil(t, err)
+		assert.Equal(t, "2021-02-01", q.DateFrom)
+
+		_, err = parseEmergingOptions(url.Values{"baselineFrom": {"2021-01-01"}}, &covince.Query{}, &opts)
+		assert.Equal(t, missingParameter("from", "recent window required"), err)
+	})
+	t.Run("rejects overlapping windows", func(t *testing.T) {
+		overlap := invalidParameter("from", "recent window overlaps the baseline")
+		for _, c := range []struct {
+			baseline url.Values
+			q        covince.Query
+			err      error
+		}{
+			{url.Values{"baselineFrom": {"2021-01-01"}, "baselineTo": {"2021-01-31"}}, covince.Query{DateFrom: "2021-01-31"}, overlap},
+			{url.Values{"baselineFrom": {"2021-01-01"}}, covince.Query{DateFrom: "2021-02-01"}, overlap},
+			{url.Values{"baselineTo": {"2021-01-31"}}, covince.Query{DateFrom: "2020-12-01", DateTo: "2020-12-31"}, overlap},
+			{url.Values{"baselineFrom": {"2021-02-01"}}, covince.Query{DateFrom: "2021-01-01", DateTo: "2021-01-31"}, nil},
+			{url.Values{"baselineTo": {"2021-01-31"}}, covince.Query{DateFrom: "2021-02-01"}, nil},
+		} {
+			_, err := parseEmergingOptions(c.baseline, &c.q, &opts)
+			if c.err == nil {
+				assert.Nil(t, err, c.baseline)
+			} else {
+				assert.Equal(t, c.err, err, c.baseline)
+			}
+		}
+	})
+	t.Run("requires parent with several lineages", func(t *testing.T) {
+		qs := url.Values{"baselineTo": {"2021-01-01"}}
+		q := covince.Query{Lineages: []covince.QueryLineage{{Key: "A"}, {Key: "B"}}}
+		_, err := parseEmergingOptions(qs, &q, &opts)
+		assert.Equal(t, missingParameter("parent", "parent required with several lineages"), err)
+		qs.Set("parent", "B")
+		_, err = parseEmergingOptions(qs, &q, &opts)
+		assert.Nil(t, err)
+	})
+}
+
+func TestAreaHierarchy(t *testing.T) {
+	h := covince.CreateAreaHierarchy([]string{"ltla", "region"})
+	h.AddArea([]string{"E1", "London"})
+	opts := Opts{AreaHierarchy: h}
+
+	t.Run("can parse area at level", func(t *testing.T) {
+		q, err := parseQuery(url.Values{"area": {"region:London"}}, &opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if !q.AreaSet["E1"] {
+			t.Error("expected E1 in area set")
+		}
+	})
+	t.Run("error if area unknown", func(t *testing.T) {
+		_, err := parseQuery(url.Values{"area": {"region:Nowhere"}}, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+	t.Run("error if area level unknown", func(t *testing.T) {
+		_, err := parseAreaLevel(url.Values{"areaLevel": {"county"}}, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestMultipleAreas(t *testing.T) {
+	h := covince.CreateAreaHierarchy([]string{"ltla", "region"})
+	h.AddArea([]string{"E1", "London"})
+	h.AddArea([]string{"E2", "London"})
+	opts := Opts{AreaHierarchy: h}
+
+	t.Run("single area", func(t *testing.T) {
+		q, _ := parseQuery(url.Values{"area": {"E1"}}, &opts)
+		if q.Area != "E1" || q.AreaSet != nil {
+			t.Errorf("expected single area, got %v", q)
+		}
+	})
+	t.Run("list of areas", func(t *testing.T) {
+		q, err := parseQuery(url.Values{"area": {"region:London,W1"}}, &opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(q.AreaSet) != 3 || !q.AreaSet["W1"] {
+			t.Errorf("expected three areas, got %v", q.AreaSet)
+		}
+	})
+	t.Run("excluding areas", func(t *testing.T) {
+		q, err := parseQuery(url.Values{"area": {"region:London"}, "excludingAreas": {"E2"}}, &opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if !q.ExcludedAreas["E2"] {
+			t.Errorf("expected E2 excluded, got %v", q.ExcludedAreas)
+		}
+	})
+	t.Run("invalid breakdown", func(t *testing.T) {
+		_, err := parseBreakdown(url.Values{"breakdown": {"lineage"}}, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+}
+
+func TestParseNormalise(t *testing.T) {
+	t.Run("error if population not loaded", func(t *testing.T) {
+		_, _, err := parseNormalise(url.Values{"normalise": {"population"}}, &Opts{})
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+	t.Run("can parse both", func(t *testing.T) {
+		opts := Opts{Population: covince.Population{"A": 1}}
+		byPopulation, bySequenced, err := parseNormalise(url.Values{"normalise": {"population,sequenced"}}, &opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if !byPopulation || !bySequenced {
+			t.Error("expected both normalisations")
+		}
+	})
+}
+
+func TestMetadataColumns(t *testing.T) {
+	opts := Opts{MetadataColumns: []string{"sampleType", "ageBand"}}
+
+	t.Run("can filter by metadata", func(t *testing.T) {
+		q, err := parseQuery(url.Values{"ageBand": {"18-30,31-50"}}, &opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(q.Metadata) != 1 || q.Metadata[0].Column != 1 || len(q.Metadata[0].Values) != 2 {
+			t.Errorf("unexpected metadata filter: %v", q.Metadata)
+		}
+	})
+	t.Run("can break down by metadata", func(t *testing.T) {
+		d, err := parseBreakdown(url.Values{"breakdown": {"sampleType"}}, &opts)
+		if err != nil || d == nil {
+			t.Error("expected dimension", err)
+		}
+	})
+	t.Run("rejects reserved names", func(t *testing.T) {
+		assert.Nil(t, CheckMetadataColumns(opts.MetadataColumns))
+		assert.EqualError(t, CheckMetadataColumns([]string{"sampleType", "area"}), `metadata column "area" is a reserved name`)
+		assert.Error(t, CheckMetadataColumns([]string{"lineage"}))
+	})
+}
+
+func TestParseGroupBy(t *testing.T) {
+	opts := Opts{MetadataColumns: []string{"sampleType"}}
+	q := covince.Query{}
+
+	t.Run("can parse dimensions", func(t *testing.T) {
+		groups, err := parseGroupBy(url.Values{"groupBy": {"date:week,area,sampleType"}}, &q, &opts)
+		if err != nil {
+			t.Error(err)
+		}
+		if len(groups) != 3 || groups[2].Dimension == nil {
+			t.Errorf("unexpected groups: %v", groups)
+		}
+	})
+	t.Run("error if too many dimensions", func(t *testing.T) {
+		_, err := parseGroupBy(url.Values{"groupBy": {"date,area,gene,mutation"}}, &q, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+	t.Run("error if lineage without lineages", func(t *testing.T) {
+		_, err := parseGroupBy(url.Values{"groupBy": {"lineage"}}, &q, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+	t.Run("error if unknown dimension", func(t *testing.T) {
+		_, err := parseGroupBy(url.Values{"groupBy": {"area:week"}}, &q, &opts)
+		if err == nil {
+			t.Error("expected error")
+		}
+	})
+}
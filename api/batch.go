@@ -0,0 +1,122 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/covince/covince-backend-v2/covince"
+)
+
+const MAX_BATCH_QUERIES = 16
+
+type BatchQuery struct {
+	Endpoint string    `json:"endpoint"`
+	Query    QueryBody `json:"query"`
+}
+
+type BatchBody struct {
+	Queries map[string]BatchQuery `json:"queries"`
+}
+
+// subQueryError qualifies the message and parameter with the sub-query id.
+func subQueryError(id string, err error) *Error {
+	var e Error
+	var ae *Error
+	if errors.As(err, &ae) {
+		e = *ae
+	} else {
+		e = *invalidParameter("", "%v", err)
+	}
+	e.Message = fmt.Sprintf("%v: %v", id, e.Message)
+	if e.Parameter != "" {
+		e.Parameter = fmt.Sprintf("queries.%v.%v", id, e.Parameter)
+	}
+	return &e
+}
+
+type batchRequest struct {
+	Aggregations map[string]*aggregation
+	// canonical form of every sub-query, used for caching
+	Key string
+}
+
+func parseBatch(r io.Reader, opts *Opts, sequenced covince.Index) (*batchRequest, error) {
+	var b BatchBody
+	d := json.NewDecoder(io.LimitReader(r, MAX_BODY_BYTES))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&b); err != nil {
+		return nil, invalidBody("invalid request body: %v", err)
+	}
+	if len(b.Queries) == 0 {
+		return nil, missingParameter("queries", "no queries")
+	}
+	if len(b.Queries) > MAX_BATCH_QUERIES {
+		return nil, invalidParameter("queries", "too many queries, maximum is %v", MAX_BATCH_QUERIES)
+	}
+
+	aggregations := make(map[string]*aggregation, len(b.Queries))
+	keys := make([]string, 0, len(b.Queries))
+	for id, bq := range b.Queries {
+		qs, err := bq.Query.values(opts)
+		if err != nil {
+			return nil, subQueryError(id, err)
+		}
+		q, err := parseQuery(qs, opts)
+		if err != nil {
+			return nil, subQueryError(id, err)
+		}
+		a, err := newAggregation("/"+bq.Endpoint, qs, q, opts, sequenced)
+		if err != nil {
+			return nil, subQueryError(id, err)
+		}
+		if a == nil {
+			return nil, subQueryError(id, invalidParameter("endpoint", "endpoint not supported in batch: %v", bq.Endpoint))
+		}
+		aggregations[id] = a
+		keys = append(keys, id+"="+canonicalQuery("/"+bq.Endpoint, qs, opts))
+	}
+	sort.Strings(keys)
+	return &batchRequest{
+		Aggregations: aggregations,
+		Key:          "/batch?" + strings.Join(keys, "&"),
+	}, nil
+}
+
+func (br *batchRequest) cubeable() bool {
+	for _, a := range br.Aggregations {
+		if !a.cubeable {
+			return false
+		}
+	}
+	return true
+}
+
+// batch computes every aggregation in a single pass over the records.
+func batch(ctx context.Context, scan covince.ContextIteratorFunc, threads int, aggregations map[string]*aggregation) (map[string]interface{}, error) {
+	ids := make([]string, 0, len(aggregations))
+	for id := range aggregations {
+		ids = append(ids, id)
+	}
+	p, err := covince.MapReduce(ctx, scan, threads, func() covince.Partial {
+		partials := make(covince.Partials, len(ids))
+		for i, id := range ids {
+			partials[i] = aggregations[id].newPartial()
+		}
+		return partials
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	partials := p.(covince.Partials)
+	results := make(map[string]interface{}, len(aggregations))
+	for i, id := range ids {
+		results[id] = aggregations[id].result(partials[i])
+	}
+	return results, nil
+}
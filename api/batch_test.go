@@ -0,0 +1,59 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	scans := 0
+	foreach := func(agg func(r *covince.Record), sliceIndex int) {
+		scans++
+		testForeach(agg, sliceIndex)
+	}
+	handler := CovinceAPI(Opts{MaxLineages: 16}, covince.WithContext(foreach))
+
+	t.Run("computes all queries in one scan", func(t *testing.T) {
+		scans = 0
+		body := `{"queries": {
+			"freq": {"endpoint": "frequency", "query": {"lineages": ["B.1", "A"]}},
+			"total": {"endpoint": "spatiotemporal/total", "query": {"lineages": ["B.1", "A"]}},
+			"lins": {"endpoint": "lineages", "query": {"from": "2021-01-02"}}
+		}}`
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, 1, scans)
+		assert.JSONEq(t, `{
+			"freq": {"2021-01-01": {"B.1": 2}, "2021-01-02": {"A": 3}},
+			"total": {"2021-01-01": {"E1": 2}, "2021-01-02": {"E2": 3}},
+			"lins": {"A.": 3}
+		}`, rw.Body.String())
+	})
+
+	t.Run("reports invalid sub-query", func(t *testing.T) {
+		body := `{"queries": {"bad": {"endpoint": "frequency", "query": {"from": "never"}}}}`
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.JSONEq(t, `{"error": {"code": "invalid_parameter", "message": "bad: invalid date", "parameter": "queries.bad.from"}}`, rw.Body.String())
+	})
+
+	t.Run("rejects unsupported endpoint", func(t *testing.T) {
+		body := `{"queries": {"m": {"endpoint": "mutations", "query": {}}}}`
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("POST", "/batch", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+	})
+
+	t.Run("requires POST", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("GET", "/batch", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+	})
+}
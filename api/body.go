@@ -0,0 +1,118 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const MAX_BODY_BYTES = 1 << 20
+
+type SearchBody struct {
+	Parent      string `json:"parent"`
+	Skip        *int   `json:"skip"`
+	Limit       *int   `json:"limit"`
+	Sort        string `json:"sort"`
+	Direction   string `json:"direction"`
+	GrowthStart string `json:"growthStart"`
+	GrowthEnd   string `json:"growthEnd"`
+}
+
+// QueryBody is the JSON equivalent of the query string, so that long
+// queries can be sent with POST. Endpoint specific parameters, such as
+// groupBy or normalise, are passed through Options.
+type QueryBody struct {
+	Lineages      []string            `json:"lineages"`
+	Excluding     []string            `json:"excluding"`
+	Areas         []string            `json:"areas"`
+	ExcludedAreas []string            `json:"excludedAreas"`
+	DateFrom      string              `json:"from"`
+	DateTo        string              `json:"to"`
+	Gene          string              `json:"gene"`
+	Filter        string              `json:"filter"`
+	Metadata      map[string][]string `json:"metadata"`
+	Search        *SearchBody         `json:"search"`
+	Options       map[string]string   `json:"options"`
+}
+
+// the parameters set by the typed fields of QueryBody, which can't be
+// passed through Options
+var bodyParameters = map[string]bool{
+	"lineages": true, "excluding": true, "area": true, "excludingAreas": true,
+	"from": true, "to": true, "gene": true, "filter": true,
+	"parent": true, "skip": true, "limit": true, "sort": true,
+	"direction": true, "growthStart": true, "growthEnd": true,
+}
+
+func isMetadataColumn(c string, opts *Opts) bool {
+	for _, m := range opts.MetadataColumns {
+		if m == c {
+			return true
+		}
+	}
+	return false
+}
+
+func setIfPresent(qs url.Values, key string, value string) {
+	if value != "" {
+		qs.Set(key, value)
+	}
+}
+
+func setListIfPresent(qs url.Values, key string, values []string) {
+	if values != nil {
+		qs.Set(key, strings.Join(values, ","))
+	}
+}
+
+func (b *QueryBody) values(opts *Opts) (url.Values, error) {
+	qs := url.Values{}
+	setListIfPresent(qs, "lineages", b.Lineages)
+	setListIfPresent(qs, "excluding", b.Excluding)
+	setListIfPresent(qs, "area", b.Areas)
+	setListIfPresent(qs, "excludingAreas", b.ExcludedAreas)
+	setIfPresent(qs, "from", b.DateFrom)
+	setIfPresent(qs, "to", b.DateTo)
+	setIfPresent(qs, "gene", b.Gene)
+	setIfPresent(qs, "filter", b.Filter)
+	for c, values := range b.Metadata {
+		if !isMetadataColumn(c, opts) {
+			return nil, invalidParameter("metadata", "unknown metadata column %q", c)
+		}
+		setListIfPresent(qs, c, values)
+	}
+	if s := b.Search; s != nil {
+		setIfPresent(qs, "parent", s.Parent)
+		if s.Skip != nil {
+			qs.Set("skip", strconv.Itoa(*s.Skip))
+		}
+		if s.Limit != nil {
+			qs.Set("limit", strconv.Itoa(*s.Limit))
+		}
+		setIfPresent(qs, "sort", s.Sort)
+		setIfPresent(qs, "direction", s.Direction)
+		setIfPresent(qs, "growthStart", s.GrowthStart)
+		setIfPresent(qs, "growthEnd", s.GrowthEnd)
+	}
+	for k, v := range b.Options {
+		if bodyParameters[k] || isMetadataColumn(k, opts) {
+			return nil, invalidParameter("options", "%v must be set by its own field", k)
+		}
+		setIfPresent(qs, k, v)
+	}
+	return qs, nil
+}
+
+// parseBody converts a JSON body into query string values, so that POST
+// requests go through the same validation as GET requests.
+func parseBody(r io.Reader, opts *Opts) (url.Values, error) {
+	var b QueryBody
+	d := json.NewDecoder(io.LimitReader(r, MAX_BODY_BYTES))
+	d.DisallowUnknownFields()
+	if err := d.Decode(&b); err != nil {
+		return nil, invalidBody("invalid request body: %v", err)
+	}
+	return b.values(opts)
+}
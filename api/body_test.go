@@ -0,0 +1,80 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func testForeach(agg func(r *covince.Record), sliceIndex int) {
+	records := []covince.Record{
+		{PangoClade: &covince.Value{Value: "B.1."}, Date: &covince.Value{Value: "2021-01-01"}, Area: &covince.Value{Value: "E1"}, Count: 2},
+		{PangoClade: &covince.Value{Value: "A."}, Date: &covince.Value{Value: "2021-01-02"}, Area: &covince.Value{Value: "E2"}, Count: 3},
+	}
+	for _, r := range records {
+		agg(&r)
+	}
+}
+
+func TestParseBody(t *testing.T) {
+	opts := Opts{MetadataColumns: []string{"sampleType"}}
+	t.Run("converts to query string", func(t *testing.T) {
+		body := `{
+			"lineages": ["B.1", "B+S:N501Y"],
+			"areas": ["E1", "E2"],
+			"from": "2021-01-01",
+			"metadata": {"sampleType": ["hospital"]},
+			"search": {"parent": "B", "skip": 0, "limit": 10},
+			"options": {"groupBy": "date,area"}
+		}`
+		qs, err := parseBody(strings.NewReader(body), &opts)
+		assert.Nil(t, err)
+		assert.Equal(t, url.Values{
+			"lineages":   {"B.1,B+S:N501Y"},
+			"area":       {"E1,E2"},
+			"from":       {"2021-01-01"},
+			"sampleType": {"hospital"},
+			"parent":     {"B"},
+			"skip":       {"0"},
+			"limit":      {"10"},
+			"groupBy":    {"date,area"},
+		}, qs)
+	})
+	t.Run("rejects unknown fields", func(t *testing.T) {
+		_, err := parseBody(strings.NewReader(`{"lineage": "B"}`), &opts)
+		assert.Error(t, err)
+	})
+	t.Run("rejects unknown metadata columns", func(t *testing.T) {
+		_, err := parseBody(strings.NewReader(`{"metadata": {"area": ["E1"]}}`), &opts)
+		assert.Equal(t, invalidParameter("metadata", `unknown metadata column "area"`), err)
+	})
+	t.Run("rejects options with fields of their own", func(t *testing.T) {
+		_, err := parseBody(strings.NewReader(`{"options": {"from": "2021-01-01"}}`), &opts)
+		assert.Equal(t, invalidParameter("options", "from must be set by its own field"), err)
+		_, err = parseBody(strings.NewReader(`{"options": {"sampleType": "hospital"}}`), &opts)
+		assert.Equal(t, invalidParameter("options", "sampleType must be set by its own field"), err)
+	})
+}
+
+func TestPostQuery(t *testing.T) {
+	handler := CovinceAPI(Opts{MaxLineages: 16}, covince.WithContext(testForeach))
+
+	get := httptest.NewRecorder()
+	handler(get, httptest.NewRequest("GET", "/frequency?lineages=B.1,A&from=2021-01-02", nil))
+	post := httptest.NewRecorder()
+	handler(post, httptest.NewRequest("POST", "/frequency", strings.NewReader(`{"lineages": ["B.1", "A"], "from": "2021-01-02"}`)))
+
+	assert.Equal(t, http.StatusOK, post.Code)
+	assert.JSONEq(t, `{"2021-01-02": {"A": 3}}`, post.Body.String())
+	assert.Equal(t, get.Body.String(), post.Body.String())
+
+	invalid := httptest.NewRecorder()
+	handler(invalid, httptest.NewRequest("POST", "/frequency", strings.NewReader(`{"from": "yesterday"}`)))
+	assert.Equal(t, http.StatusBadRequest, invalid.Code)
+	assert.JSONEq(t, `{"error": {"code": "invalid_parameter", "message": "invalid date", "parameter": "from"}}`, invalid.Body.String())
+}
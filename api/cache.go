@@ -0,0 +1,119 @@
+package api
+
+import (
+	"container/list"
+	"sync"
+)
+
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int   `json:"bytes"`
+	Budget    int   `json:"budget"`
+}
+
+type cachedResponse struct {
+	key         string
+	contentType string
+	body        []byte
+}
+
+func (e *cachedResponse) size() int {
+	return len(e.key) + len(e.body)
+}
+
+// ResultCache holds encoded responses up to a budget in bytes, evicting the
+// least recently used. Entries are dropped whenever the dataset version
+// changes, and results of older versions still being computed are neither
+// served nor stored. A nil cache never hits.
+type ResultCache struct {
+	mu      sync.Mutex
+	version int64
+	entries map[string]*list.Element
+	lru     *list.List
+	stats   CacheStats
+}
+
+func NewResultCache(budget int) *ResultCache {
+	if budget <= 0 {
+		return nil
+	}
+	return &ResultCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		stats:   CacheStats{Budget: budget},
+	}
+}
+
+// checkVersion returns false for an older version than the cache holds.
+// The caller must hold the lock.
+func (c *ResultCache) checkVersion(version int64) bool {
+	if version < c.version {
+		return false
+	}
+	if version > c.version {
+		c.entries = make(map[string]*list.Element)
+		c.lru.Init()
+		c.stats.Entries = 0
+		c.stats.Bytes = 0
+		c.version = version
+	}
+	return true
+}
+
+func (c *ResultCache) get(version int64, key string) (*cachedResponse, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkVersion(version) {
+		c.stats.Misses++
+		return nil, false
+	}
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		c.stats.Hits++
+		return el.Value.(*cachedResponse), true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+func (c *ResultCache) put(version int64, key string, contentType string, body []byte) {
+	e := &cachedResponse{key: key, contentType: contentType, body: body}
+	if c == nil || e.size() > c.stats.Budget {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkVersion(version) {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.stats.Bytes -= el.Value.(*cachedResponse).size()
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	for c.stats.Bytes+e.size() > c.stats.Budget {
+		evicted := c.lru.Remove(c.lru.Back()).(*cachedResponse)
+		delete(c.entries, evicted.key)
+		c.stats.Bytes -= evicted.size()
+		c.stats.Evictions++
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.stats.Bytes += e.size()
+	c.stats.Entries = len(c.entries)
+}
+
+func (c *ResultCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Entries = len(c.entries)
+	return c.stats
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResultCache(t *testing.T) {
+	t.Run("evicts least recently used", func(t *testing.T) {
+		c := NewResultCache(12)
+		c.put(1, "a", "", []byte("1234"))
+		c.put(1, "b", "", []byte("1234"))
+		c.get(1, "a")
+		c.put(1, "c", "", []byte("1234"))
+		_, ok := c.get(1, "b")
+		assert.False(t, ok)
+		_, ok = c.get(1, "a")
+		assert.True(t, ok)
+		stats := c.Stats()
+		assert.Equal(t, int64(1), stats.Evictions)
+		assert.Equal(t, 10, stats.Bytes)
+		assert.Equal(t, 2, stats.Entries)
+	})
+	t.Run("skips entries larger than budget", func(t *testing.T) {
+		c := NewResultCache(4)
+		c.put(1, "a", "", []byte("1234"))
+		assert.Equal(t, 0, c.Stats().Entries)
+	})
+	t.Run("invalidates on new version", func(t *testing.T) {
+		c := NewResultCache(100)
+		c.put(1, "a", "", []byte("1234"))
+		_, ok := c.get(2, "a")
+		assert.False(t, ok)
+		assert.Equal(t, 0, c.Stats().Bytes)
+	})
+	t.Run("ignores older versions", func(t *testing.T) {
+		c := NewResultCache(100)
+		c.put(2, "a", "", []byte("1234"))
+		c.put(1, "b", "", []byte("1234"))
+		_, ok := c.get(1, "a")
+		assert.False(t, ok)
+		_, ok = c.get(2, "a")
+		assert.True(t, ok)
+		assert.Equal(t, 1, c.Stats().Entries)
+	})
+	t.Run("nil cache never hits", func(t *testing.T) {
+		c := NewResultCache(0)
+		c.put(1, "a", "", []byte("1234"))
+		_, ok := c.get(1, "a")
+		assert.False(t, ok)
+	})
+}
+
+func TestCachedResponses(t *testing.T) {
+	scans := 0
+	foreach := func(agg func(r *covince.Record), sliceIndex int) {
+		scans++
+		testForeach(agg, sliceIndex)
+	}
+	cache := NewResultCache(1024)
+	handler := CovinceAPI(Opts{MaxLineages: 16, Cache: cache}, covince.WithContext(foreach))
+	scans = 0
+
+	first := httptest.NewRecorder()
+	handler(first, httptest.NewRequest("GET", "/frequency?lineages=A,B.1", nil))
+	second := httptest.NewRecorder()
+	handler(second, httptest.NewRequest("GET", "/frequency?lineages=B.1,A", nil))
+	assert.Equal(t, 1, scans)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+
+	s := cache.Stats()
+	assert.Equal(t, int64(1), s.Hits)
+	assert.Equal(t, int64(1), s.Misses)
+	assert.Equal(t, 1, s.Entries)
+	assert.Greater(t, s.Bytes, 0)
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", "/cache", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
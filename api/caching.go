@@ -0,0 +1,109 @@
+package api
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// parameters whose comma separated values can be given in any order
+var unorderedParams = map[string]bool{
+	"lineages":       true,
+	"excluding":      true,
+	"area":           true,
+	"excludingAreas": true,
+	"normalise":      true,
+}
+
+// parameters that can be repeated, in any order, each value being one item
+var repeatedParams = map[string]bool{
+	"lineage": true,
+}
+
+func sortUnique(values []string) []string {
+	sort.Strings(values)
+	unique := values[:0]
+	for i, v := range values {
+		if i == 0 || v != values[i-1] {
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
+
+func sortList(s string) string {
+	return strings.Join(sortUnique(strings.Split(s, ",")), ",")
+}
+
+// canonicalQuery normalises an endpoint and its parameters so that
+// equivalent requests produce the same string.
+func canonicalQuery(endpoint string, qs url.Values, opts *Opts) string {
+	metadata := make(map[string]bool, len(opts.MetadataColumns))
+	for _, c := range opts.MetadataColumns {
+		metadata[c] = true
+	}
+	canonical := url.Values{}
+	for k, v := range qs {
+		values := make([]string, len(v))
+		for i, s := range v {
+			if unorderedParams[k] || metadata[k] {
+				values[i] = sortList(s)
+			} else {
+				values[i] = s
+			}
+		}
+		if repeatedParams[k] {
+			values = sortUnique(values)
+		}
+		canonical[k] = values
+	}
+	return endpoint + "?" + canonical.Encode()
+}
+
+func etag(lastModified int64, key string) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%v\n%v", lastModified, key)
+	return `"` + hex.EncodeToString(h.Sum(nil))[:16] + `"`
+}
+
+func setCacheHeaders(rw http.ResponseWriter, opts *Opts, tag string) {
+	h := rw.Header()
+	h.Set("ETag", tag)
+	h.Set("Last-Modified", time.UnixMilli(opts.LastModified).UTC().Format(http.TimeFormat))
+	if opts.CacheMaxAge > 0 {
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%v", opts.CacheMaxAge))
+	} else {
+		h.Set("Cache-Control", "public, no-cache")
+	}
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since
+// only when no entity tags were sent.
+func notModified(r *http.Request, opts *Opts, tag string) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == tag || t == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		since, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		lastModified := time.UnixMilli(opts.LastModified).Truncate(time.Second)
+		return !lastModified.After(since)
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalQuery(t *testing.T) {
+	opts := Opts{MetadataColumns: []string{"sampleType"}}
+	a := canonicalQuery("/frequency", url.Values{"lineages": {"B,A,A"}, "area": {"E2,E1"}, "sampleType": {"b,a"}, "from": {""}}, &opts)
+	b := canonicalQuery("/frequency", url.Values{"sampleType": {"a,b"}, "area": {"E1,E2"}, "lineages": {"A,B"}, "from": {""}}, &opts)
+	assert.Equal(t, a, b)
+
+	t.Run("repeated values", func(t *testing.T) {
+		a := canonicalQuery("/frequency", url.Values{"lineage": {"B", "A+S:E484K", "B"}}, &opts)
+		b := canonicalQuery("/frequency", url.Values{"lineage": {"A+S:E484K", "B"}}, &opts)
+		assert.Equal(t, a, b)
+		assert.NotEqual(t, a, canonicalQuery("/frequency", url.Values{"lineage": {"B"}}, &opts))
+		assert.NotEqual(t, a, canonicalQuery("/frequency", url.Values{"lineage": {"B", "A"}}, &opts))
+		// a comma is part of a lineage value, not a separator
+		assert.NotEqual(t, canonicalQuery("/frequency", url.Values{"lineage": {"A,B"}}, &opts), canonicalQuery("/frequency", url.Values{"lineage": {"B,A"}}, &opts))
+	})
+	t.Run("keys with a leading empty value", func(t *testing.T) {
+		a := canonicalQuery("/frequency", url.Values{"lineage": {"", "B"}}, &opts)
+		assert.NotEqual(t, canonicalQuery("/frequency", url.Values{}, &opts), a)
+		assert.Contains(t, a, "lineage=B")
+		assert.NotEqual(t, canonicalQuery("/lineages", url.Values{"area": {""}}, &opts), canonicalQuery("/lineages", url.Values{}, &opts))
+	})
+
+	c := canonicalQuery("/aggregate", url.Values{"groupBy": {"date,area"}}, &opts)
+	d := canonicalQuery("/aggregate", url.Values{"groupBy": {"area,date"}}, &opts)
+	assert.NotEqual(t, c, d)
+}
+
+func TestConditionalRequests(t *testing.T) {
+	lastModified := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	opts := Opts{MaxLineages: 16, LastModified: lastModified.UnixMilli(), CacheMaxAge: 60}
+	handler := CovinceAPI(opts, covince.WithContext(testForeach))
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", "/lineages?area=E1", nil))
+	assert.Equal(t, http.StatusOK, rw.Code)
+	tag := rw.Header().Get("ETag")
+	assert.NotEmpty(t, tag)
+	assert.Equal(t, "Tue, 01 Jun 2021 12:00:00 GMT", rw.Header().Get("Last-Modified"))
+	assert.Equal(t, "public, max-age=60", rw.Header().Get("Cache-Control"))
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/lineages?area=E1", nil)
+		r.Header.Set("If-None-Match", tag)
+		handler(rw, r)
+		assert.Equal(t, http.StatusNotModified, rw.Code)
+		assert.Empty(t, rw.Body.String())
+
+		rw = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/lineages?area=E2", nil)
+		r.Header.Set("If-None-Match", tag)
+		handler(rw, r)
+		assert.Equal(t, http.StatusOK, rw.Code)
+	})
+	t.Run("If-Modified-Since", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/lineages?area=E1", nil)
+		r.Header.Set("If-Modified-Since", lastModified.Format(http.TimeFormat))
+		handler(rw, r)
+		assert.Equal(t, http.StatusNotModified, rw.Code)
+
+		rw = httptest.NewRecorder()
+		r = httptest.NewRequest("GET", "/lineages?area=E1", nil)
+		r.Header.Set("If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat))
+		handler(rw, r)
+		assert.Equal(t, http.StatusOK, rw.Code)
+	})
+	t.Run("no cache headers on errors", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("GET", "/lineages?from=never", nil))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.Empty(t, rw.Header().Get("ETag"))
+	})
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"sync"
+)
+
+type inflightCall struct {
+	done        chan struct{}
+	waiters     int
+	cancel      context.CancelFunc
+	contentType string
+	body        []byte
+	err         error
+}
+
+// coalescer shares one computation between concurrent identical requests.
+// The computation is cancelled once every waiting request has gone away.
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[string]*inflightCall)}
+}
+
+type computeFunc func(ctx context.Context) (string, []byte, error)
+
+func (c *coalescer) do(ctx context.Context, key string, fn computeFunc) (string, []byte, error) {
+	c.mu.Lock()
+	call, ok := c.calls[key]
+	if ok {
+		call.waiters++
+	} else {
+		computeCtx, cancel := context.WithCancel(context.Background())
+		call = &inflightCall{
+			done:    make(chan struct{}),
+			waiters: 1,
+			cancel:  cancel,
+		}
+		c.calls[key] = call
+		go func() {
+			call.contentType, call.body, call.err = fn(computeCtx)
+			c.mu.Lock()
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			c.mu.Unlock()
+			cancel()
+			close(call.done)
+		}()
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.contentType, call.body, call.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// later requests must not join a cancelled computation
+			if c.calls[key] == call {
+				delete(c.calls, key)
+			}
+			call.cancel()
+		}
+		c.mu.Unlock()
+		return "", nil, ctx.Err()
+	}
+}
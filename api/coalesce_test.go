@@ -0,0 +1,92 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalescer(t *testing.T) {
+	t.Run("shares concurrent computations", func(t *testing.T) {
+		c := newCoalescer()
+		var calls int32
+		release := make(chan struct{})
+		fn := func(ctx context.Context) (string, []byte, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return "application/json", []byte("{}"), nil
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, body, err := c.do(context.Background(), "key", fn)
+				assert.Nil(t, err)
+				assert.Equal(t, "{}", string(body))
+			}()
+		}
+		// wait for every request to join before completing
+		for {
+			c.mu.Lock()
+			call := c.calls["key"]
+			joined := call != nil && call.waiters == 5
+			c.mu.Unlock()
+			if joined {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+		wg.Wait()
+		assert.Equal(t, int32(1), calls)
+	})
+
+	t.Run("cancels once all waiters leave", func(t *testing.T) {
+		c := newCoalescer()
+		cancelled := make(chan struct{})
+		fn := func(ctx context.Context) (string, []byte, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return "", nil, ctx.Err()
+		}
+
+		a, cancelA := context.WithCancel(context.Background())
+		b, cancelB := context.WithCancel(context.Background())
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() { defer wg.Done(); c.do(a, "key", fn) }()
+		go func() { defer wg.Done(); c.do(b, "key", fn) }()
+
+		for {
+			c.mu.Lock()
+			call := c.calls["key"]
+			joined := call != nil && call.waiters == 2
+			c.mu.Unlock()
+			if joined {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		cancelA()
+		select {
+		case <-cancelled:
+			t.Error("cancelled while a client was still waiting")
+		case <-time.After(10 * time.Millisecond):
+		}
+
+		cancelB()
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Error("not cancelled after all clients left")
+		}
+		wg.Wait()
+	})
+}
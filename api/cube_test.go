@@ -0,0 +1,20 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFromCube(t *testing.T) {
+	q := &covince.Query{Lineages: []covince.QueryLineage{{Key: "B", PangoClade: "B."}}}
+	assert.True(t, fromCube(q, url.Values{"breakdown": {"area"}}))
+	assert.False(t, fromCube(q, url.Values{"breakdown": {"sampleType"}}))
+	q.Metadata = []covince.MetadataFilter{{Column: 0, Values: map[string]bool{"hospital": true}}}
+	assert.False(t, fromCube(q, url.Values{}))
+	q.Metadata = nil
+	q.Excluding = []covince.QueryLineage{{Key: "A+S:N501Y", PangoClade: "A.", Mutations: []covince.Mutation{{Prefix: "S", Suffix: "N501Y"}}}}
+	assert.False(t, fromCube(q, url.Values{}))
+}
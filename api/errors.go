@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	CODE_INVALID_PARAMETER  = "invalid_parameter"
+	CODE_MISSING_PARAMETER  = "missing_parameter"
+	CODE_UNAVAILABLE        = "unavailable"
+	CODE_INVALID_BODY       = "invalid_body"
+	CODE_NOT_FOUND          = "not_found"
+	CODE_METHOD_NOT_ALLOWED = "method_not_allowed"
+	CODE_INTERNAL           = "internal"
+	CODE_TIMEOUT            = "timeout"
+	CODE_CANCELLED          = "cancelled"
+)
+
+// Error is returned to clients as {"error": {...}}, with Code suitable for
+// branching on and Parameter naming the offending input, if any.
+type Error struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	Parameter string `json:"parameter,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+type errorEnvelope struct {
+	Error *Error `json:"error"`
+}
+
+func invalidParameter(param string, format string, a ...interface{}) *Error {
+	return &Error{
+		Status:    http.StatusBadRequest,
+		Code:      CODE_INVALID_PARAMETER,
+		Message:   fmt.Sprintf(format, a...),
+		Parameter: param,
+	}
+}
+
+func missingParameter(param string, format string, a ...interface{}) *Error {
+	return &Error{
+		Status:    http.StatusBadRequest,
+		Code:      CODE_MISSING_PARAMETER,
+		Message:   fmt.Sprintf(format, a...),
+		Parameter: param,
+	}
+}
+
+func unavailable(param string, format string, a ...interface{}) *Error {
+	return &Error{
+		Status:    http.StatusBadRequest,
+		Code:      CODE_UNAVAILABLE,
+		Message:   fmt.Sprintf(format, a...),
+		Parameter: param,
+	}
+}
+
+func invalidBody(format string, a ...interface{}) *Error {
+	return &Error{
+		Status:  http.StatusBadRequest,
+		Code:    CODE_INVALID_BODY,
+		Message: fmt.Sprintf(format, a...),
+	}
+}
+
+var errNotFound = &Error{
+	Status:  http.StatusNotFound,
+	Code:    CODE_NOT_FOUND,
+	Message: "endpoint not found",
+}
+
+var errMethodNotAllowed = &Error{
+	Status:  http.StatusMethodNotAllowed,
+	Code:    CODE_METHOD_NOT_ALLOWED,
+	Message: "method not allowed",
+}
+
+var errTimeout = &Error{
+	Status:  http.StatusGatewayTimeout,
+	Code:    CODE_TIMEOUT,
+	Message: "query timed out",
+}
+
+var errCancelled = &Error{
+	Status:  http.StatusServiceUnavailable,
+	Code:    CODE_CANCELLED,
+	Message: "query cancelled",
+}
+
+func writeError(rw http.ResponseWriter, err error) {
+	var e *Error
+	if errors.Is(err, context.DeadlineExceeded) {
+		e = errTimeout
+	} else if errors.Is(err, context.Canceled) {
+		e = errCancelled
+	} else if !errors.As(err, &e) {
+		e = &Error{
+			Status:  http.StatusInternalServerError,
+			Code:    CODE_INTERNAL,
+			Message: err.Error(),
+		}
+	}
+	h := rw.Header()
+	h.Del("ETag")
+	h.Del("Last-Modified")
+	h.Del("Cache-Control")
+	h.Set("Content-Type", "application/json")
+	rw.WriteHeader(e.Status)
+	json.NewEncoder(rw).Encode(errorEnvelope{Error: e})
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrors(t *testing.T) {
+	handler := CovinceAPI(Opts{MaxLineages: 16}, covince.WithContext(testForeach))
+
+	t.Run("unknown endpoint", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("GET", "/unknown", nil))
+		assert.Equal(t, http.StatusNotFound, rw.Code)
+		assert.JSONEq(t, `{"error": {"code": "not_found", "message": "endpoint not found"}}`, rw.Body.String())
+	})
+	t.Run("method not allowed", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("DELETE", "/frequency", nil))
+		assert.Equal(t, http.StatusMethodNotAllowed, rw.Code)
+		assert.Equal(t, "application/json", rw.Header().Get("Content-Type"))
+	})
+	t.Run("wrong number of lineages", func(t *testing.T) {
+		rw := httptest.NewRecorder()
+		handler(rw, httptest.NewRequest("GET", "/spatiotemporal/lineage?lineages=A,B", nil))
+		assert.Equal(t, http.StatusBadRequest, rw.Code)
+		assert.JSONEq(t, `{"error": {"code": "invalid_parameter", "message": "exactly one lineage required", "parameter": "lineages"}}`, rw.Body.String())
+	})
+	t.Run("typed errors", func(t *testing.T) {
+		_, err := parseQuery(url.Values{"gene": {"X"}}, &Opts{})
+		var e *Error
+		assert.True(t, errors.As(err, &e))
+		assert.Equal(t, CODE_INVALID_PARAMETER, e.Code)
+		assert.Equal(t, "gene", e.Parameter)
+	})
+	t.Run("invalid mutation", func(t *testing.T) {
+		opts := Opts{Genes: map[string]bool{"S": true}, MutSeparator: ":", MaxLineages: 16}
+		_, err := parseQuery(url.Values{"lineages": {"B+S"}}, &opts)
+		assert.Error(t, err)
+	})
+}
+
+func TestTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	scan := func(ctx context.Context, agg func(r *covince.Record), sliceIndex int) error {
+		// only block queries, not the scans made at startup
+		if ctx != context.Background() {
+			select {
+			case <-ctx.Done():
+			case <-block:
+			}
+		}
+		return ctx.Err()
+	}
+	opts := Opts{
+		MaxLineages:      16,
+		Timeout:          time.Hour,
+		EndpointTimeouts: map[string]time.Duration{"/lineages": time.Millisecond},
+	}
+	handler := CovinceAPI(opts, scan)
+
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", "/lineages", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.JSONEq(t, `{"error": {"code": "timeout", "message": "query timed out"}}`, rw.Body.String())
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/covince/covince-backend-v2/covince"
+)
+
+type Boundaries map[string]json.RawMessage
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Geometry   json.RawMessage        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type FeatureCollection struct {
+	Type     string     `json:"type"`
+	Features []*Feature `json:"features"`
+}
+
+type boundaryFeature struct {
+	ID         interface{}            `json:"id"`
+	Geometry   json.RawMessage        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// ParseBoundaries reads the geometry of each area from a GeoJSON
+// FeatureCollection. Areas are identified by the given feature property, or
+// by the feature id if idProperty is empty.
+func ParseBoundaries(r io.Reader, idProperty string) (Boundaries, error) {
+	var fc struct {
+		Features []boundaryFeature `json:"features"`
+	}
+	if err := json.NewDecoder(r).Decode(&fc); err != nil {
+		return nil, err
+	}
+	b := make(Boundaries, len(fc.Features))
+	for i, f := range fc.Features {
+		id := f.ID
+		if idProperty != "" {
+			id = f.Properties[idProperty]
+		}
+		if id == nil {
+			return nil, fmt.Errorf("feature %v has no area id", i)
+		}
+		b[fmt.Sprint(id)] = f.Geometry
+	}
+	return b, nil
+}
+
+func summariseDates(i covince.Index, from string, to string) map[string]int {
+	m := make(map[string]int)
+	for date, areaCounts := range i {
+		if (from != "" && date < from) || (to != "" && date > to) {
+			continue
+		}
+		for area, count := range areaCounts {
+			m[area] += count
+		}
+	}
+	return m
+}
+
+func geoJSON(i covince.Index, opts *Opts, sequenced covince.Index, so *spatiotemporalOpts, q *covince.Query) *FeatureCollection {
+	population := opts.Population
+	if so.AreaLevel != "" {
+		sequenced = opts.AreaHierarchy.RollUp(sequenced, so.AreaLevel)
+		population = opts.AreaHierarchy.RollUpPopulation(population, so.AreaLevel)
+	}
+	counts := summariseDates(i, q.DateFrom, q.DateTo)
+	totals := summariseDates(sequenced, q.DateFrom, q.DateTo)
+
+	// every area with a boundary at the level, whether or not it has sequences
+	areas := make([]string, 0, len(opts.Boundaries))
+	for area := range opts.Boundaries {
+		if so.AreaLevel == "" || opts.AreaHierarchy.HasArea(so.AreaLevel, area) {
+			areas = append(areas, area)
+		}
+	}
+	sort.Strings(areas)
+
+	fc := FeatureCollection{
+		Type:     "FeatureCollection",
+		Features: make([]*Feature, len(areas)),
+	}
+	for j, area := range areas {
+		count := counts[area]
+		properties := map[string]interface{}{
+			"area":       area,
+			"count":      count,
+			"proportion": nil,
+		}
+		if total := totals[area]; total > 0 {
+			properties["proportion"] = float64(count) / float64(total)
+		}
+		if p := population[area]; p > 0 {
+			properties["per_100k"] = float64(count) * 100000 / float64(p)
+		}
+		fc.Features[j] = &Feature{
+			Type:       "Feature",
+			ID:         area,
+			Geometry:   opts.Boundaries[area],
+			Properties: properties,
+		}
+	}
+	return &fc
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+const testBoundaries = `{
+	"type": "FeatureCollection",
+	"features": [
+		{"type": "Feature", "id": "A", "properties": {"code": "A"}, "geometry": {"type": "Point", "coordinates": [0, 0]}},
+		{"type": "Feature", "id": "B", "properties": {"code": "B"}, "geometry": {"type": "Point", "coordinates": [1, 1]}}
+	]
+}`
+
+func TestParseBoundaries(t *testing.T) {
+	b, err := ParseBoundaries(strings.NewReader(testBoundaries), "")
+	assert.Nil(t, err)
+	assert.Len(t, b, 2)
+	assert.JSONEq(t, `{"type": "Point", "coordinates": [1, 1]}`, string(b["B"]))
+
+	b, err = ParseBoundaries(strings.NewReader(testBoundaries), "code")
+	assert.Nil(t, err)
+	assert.Contains(t, b, "A")
+
+	_, err = ParseBoundaries(strings.NewReader(testBoundaries), "missing")
+	assert.Error(t, err)
+}
+
+func TestGeoJSON(t *testing.T) {
+	b, _ := ParseBoundaries(strings.NewReader(testBoundaries), "")
+	opts := Opts{
+		Boundaries: b,
+		Population: covince.Population{"A": 100000},
+	}
+	i := covince.Index{
+		"2020-09-01": {"A": 1},
+		"2020-10-01": {"A": 2},
+	}
+	sequenced := covince.Index{
+		"2020-09-01": {"A": 2, "B": 1},
+		"2020-10-01": {"A": 2, "C": 1},
+	}
+	q := covince.Query{DateFrom: "2020-10-01"}
+
+	fc := geoJSON(i, &opts, sequenced, &spatiotemporalOpts{GeoJSON: true}, &q)
+	assert.Equal(t, "FeatureCollection", fc.Type)
+	assert.Len(t, fc.Features, 2)
+	assert.Equal(t, "A", fc.Features[0].ID)
+	assert.Equal(t, 2, fc.Features[0].Properties["count"])
+	assert.Equal(t, 1.0, fc.Features[0].Properties["proportion"])
+	assert.Equal(t, 2.0, fc.Features[0].Properties["per_100k"])
+
+	t.Run("areas without sequences have a count of zero", func(t *testing.T) {
+		assert.Equal(t, "B", fc.Features[1].ID)
+		assert.Equal(t, 0, fc.Features[1].Properties["count"])
+		assert.Contains(t, fc.Features[1].Properties, "proportion")
+		assert.Nil(t, fc.Features[1].Properties["proportion"])
+	})
+
+	t.Run("boundaries are of areas at the level", func(t *testing.T) {
+		h := covince.CreateAreaHierarchy([]string{"area", "region"})
+		h.AddArea([]string{"C", "A"})
+		h.AddArea([]string{"D", "B"})
+		opts.AreaHierarchy = h
+		fc := geoJSON(h.RollUp(i, "region"), &opts, sequenced, &spatiotemporalOpts{GeoJSON: true, AreaLevel: "region"}, &q)
+		assert.Len(t, fc.Features, 2)
+		assert.Equal(t, 0, fc.Features[0].Properties["count"])
+		assert.Equal(t, 0.0, fc.Features[0].Properties["proportion"])
+		assert.Equal(t, "B", fc.Features[1].ID)
+		assert.Nil(t, fc.Features[1].Properties["proportion"])
+	})
+}
@@ -7,16 +7,26 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/covince/covince-backend-v2/covince"
 )
 
+const DEFAULT_MUT_SEPARATOR = ":"
+
 var isPangoLineage = regexp.MustCompile(`^[A-Z]{1,3}(\.[0-9]+)*$`)
 var isDateString = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
 
 func parseMutation(s string, opts *Opts) (covince.Mutation, error) {
 	var m covince.Mutation
-	split := strings.Split(s, opts.MutSeparator)
+	separator := opts.MutSeparator
+	if separator == "" {
+		separator = DEFAULT_MUT_SEPARATOR
+	}
+	split := strings.Split(s, separator)
+	if len(split) != 2 {
+		return m, fmt.Errorf("invalid mutation: %v", s)
+	}
 	for gene := range opts.Genes {
 		if gene == split[0] {
 			m.Prefix = gene
@@ -30,7 +40,55 @@ func parseMutation(s string, opts *Opts) (covince.Mutation, error) {
 	return m, nil
 }
 
-func parseLineages(lineages []string, opts *Opts) ([]covince.QueryLineage, error) {
+func isAreaAtLevel(s string, opts *Opts) bool {
+	return opts.AreaHierarchy != nil && strings.Contains(s, covince.AREA_LEVEL_SEPARATOR)
+}
+
+func parseAreas(areas []string, param string, opts *Opts) (map[string]bool, error) {
+	set := make(map[string]bool)
+	for _, a := range areas {
+		if len(a) == 0 {
+			continue
+		}
+		if isAreaAtLevel(a, opts) {
+			resolved, err := opts.AreaHierarchy.Resolve(a)
+			if err != nil {
+				return nil, invalidParameter(param, "%v", err)
+			}
+			for k := range resolved {
+				set[k] = true
+			}
+		} else {
+			set[a] = true
+		}
+	}
+	return set, nil
+}
+
+// the query parameters and groupBy dimensions, which metadata columns must
+// not be named as they are filtered by parameters of their own name
+var reservedNames = map[string]bool{
+	"area": true, "areaLevel": true, "baselineFrom": true, "baselineTo": true,
+	"breakdown": true, "date": true, "direction": true, "excluding": true,
+	"excludingAreas": true, "explain": true, "filter": true, "format": true,
+	"from": true, "gene": true, "groupBy": true, "growthEnd": true,
+	"growthStart": true, "limit": true, "lineage": true, "lineages": true,
+	"minCount": true, "mutation": true, "normalise": true, "parent": true,
+	"skip": true, "sort": true, "threshold": true, "to": true,
+}
+
+// CheckMetadataColumns returns an error for the first column with a
+// reserved name.
+func CheckMetadataColumns(columns []string) error {
+	for _, c := range columns {
+		if reservedNames[c] {
+			return fmt.Errorf("metadata column %q is a reserved name", c)
+		}
+	}
+	return nil
+}
+
+func parseLineages(lineages []string, param string, opts *Opts) ([]covince.QueryLineage, error) {
 	index := make(map[string]covince.QueryLineage)
 	for _, v := range lineages {
 		if len(v) == 0 {
@@ -39,17 +97,17 @@ func parseLineages(lineages []string, opts *Opts) ([]covince.QueryLineage, error
 		split := strings.Split(v, "+")
 		lineage := split[0]
 		if !isPangoLineage.MatchString(lineage) {
-			return nil, fmt.Errorf("invalid lineages")
+			return nil, invalidParameter(param, "invalid lineages")
 		}
 		mutStrings := split[1:]
 		if !opts.MultipleMuts && len(mutStrings) > 1 {
-			return nil, fmt.Errorf("single mutations only")
+			return nil, invalidParameter(param, "single mutations only")
 		}
 		mutations := make([]covince.Mutation, len(mutStrings))
 		for i, m := range mutStrings {
 			parsed, err := parseMutation(m, opts)
 			if err != nil {
-				return nil, err
+				return nil, invalidParameter(param, "%v", err)
 			}
 			mutations[i] = parsed
 		}
@@ -74,7 +132,7 @@ func parseLineages(lineages []string, opts *Opts) ([]covince.QueryLineage, error
 func parseQuery(qs url.Values, opts *Opts) (*covince.Query, error) {
 	q := &covince.Query{}
 	if lineage, ok := qs["lineage"]; ok {
-		p, err := parseLineages(lineage, opts)
+		p, err := parseLineages(lineage, "lineage", opts)
 		if err != nil {
 			return q, err
 		}
@@ -82,37 +140,62 @@ func parseQuery(qs url.Values, opts *Opts) (*covince.Query, error) {
 	} else if lineages, ok := qs["lineages"]; ok {
 		lineages = strings.Split(lineages[0], ",")
 		if len(lineages) > opts.MaxLineages {
-			return q, fmt.Errorf("too many lineages, maximum is %v", opts.MaxLineages)
+			return q, invalidParameter("lineages", "too many lineages, maximum is %v", opts.MaxLineages)
 		}
-		p, err := parseLineages(lineages, opts)
+		p, err := parseLineages(lineages, "lineages", opts)
 		if err != nil {
 			return q, err
 		}
 		q.Lineages = p
 	}
 	if a, ok := qs["area"]; ok && a[0] != "overview" {
-		q.Area = a[0]
+		areas := strings.Split(a[0], ",")
+		if len(areas) == 1 && !isAreaAtLevel(areas[0], opts) {
+			q.Area = areas[0]
+		} else {
+			set, err := parseAreas(areas, "area", opts)
+			if err != nil {
+				return q, err
+			}
+			q.AreaSet = set
+		}
+	}
+	if a, ok := qs["excludingAreas"]; ok {
+		set, err := parseAreas(strings.Split(a[0], ","), "excludingAreas", opts)
+		if err != nil {
+			return q, err
+		}
+		q.ExcludedAreas = set
 	}
 	if from, ok := qs["from"]; ok && len(from[0]) > 0 {
 		if !isDateString.MatchString(from[0]) {
-			return q, fmt.Errorf("invalid date")
+			return q, invalidParameter("from", "invalid date")
 		}
 		q.DateFrom = from[0]
 	}
 	if to, ok := qs["to"]; ok && len(to[0]) > 0 {
 		if !isDateString.MatchString(to[0]) {
-			return q, fmt.Errorf("invalid date")
+			return q, invalidParameter("to", "invalid date")
 		}
 		q.DateTo = to[0]
 	}
 	if excluding, ok := qs["excluding"]; ok {
 		excluding = strings.Split(excluding[0], ",")
-		excluding, err := parseLineages(excluding, opts)
+		excluding, err := parseLineages(excluding, "excluding", opts)
 		if err != nil {
 			return q, err
 		}
 		q.Excluding = excluding
 	}
+	for i, c := range opts.MetadataColumns {
+		if v, ok := qs[c]; ok && len(v[0]) > 0 {
+			values := make(map[string]bool)
+			for _, s := range strings.Split(v[0], ",") {
+				values[s] = true
+			}
+			q.Metadata = append(q.Metadata, covince.MetadataFilter{Column: i, Values: values})
+		}
+	}
 	if gene, ok := qs["gene"]; ok && len(gene[0]) > 0 {
 		for g := range opts.Genes {
 			if g == gene[0] {
@@ -121,15 +204,18 @@ func parseQuery(qs url.Values, opts *Opts) (*covince.Query, error) {
 			}
 		}
 		if q.Prefix == "" {
-			return q, fmt.Errorf("gene not recognised")
+			return q, invalidParameter("gene", "gene not recognised")
 		}
 	}
 	if filter, ok := qs["filter"]; ok && len(filter[0]) > 0 {
 		if len(filter[0]) > 24 {
-			return q, fmt.Errorf("filter string too long")
+			return q, invalidParameter("filter", "filter string too long")
 		}
 		q.SuffixFilter = filter[0]
 	}
+	if opts.Planner != nil {
+		opts.Planner.Resolve(q)
+	}
 	return q, nil
 }
 
@@ -173,3 +259,210 @@ func parseSearchOptions(qs url.Values, defaultLimit int) *covince.SearchOpts {
 
 	return &so
 }
+
+// parseEmergingOptions reads the baseline window, and defaults the recent
+// window of q to start the day after it. The windows must not overlap.
+func parseEmergingOptions(qs url.Values, q *covince.Query, opts *Opts) (*covince.EmergingOpts, error) {
+	eo := covince.EmergingOpts{
+		MinCount:       opts.MutSuppressionMin,
+		SuppressionMin: opts.MutSuppressionMin,
+		ZThreshold:     covince.DEFAULT_Z_THRESHOLD,
+	}
+
+	if from, ok := qs["baselineFrom"]; ok && len(from[0]) > 0 {
+		if !isDateString.MatchString(from[0]) {
+			return nil, invalidParameter("baselineFrom", "invalid date")
+		}
+		eo.Baseline.From = from[0]
+	}
+	if to, ok := qs["baselineTo"]; ok && len(to[0]) > 0 {
+		if !isDateString.MatchString(to[0]) {
+			return nil, invalidParameter("baselineTo", "invalid date")
+		}
+		eo.Baseline.To = to[0]
+	}
+	if eo.Baseline.From == "" && eo.Baseline.To == "" {
+		return nil, missingParameter("baselineFrom", "baseline window required")
+	}
+	if q.DateFrom == "" {
+		if eo.Baseline.To == "" {
+			return nil, missingParameter("from", "recent window required")
+		}
+		to, err := time.Parse("2006-01-02", eo.Baseline.To)
+		if err != nil {
+			return nil, invalidParameter("baselineTo", "invalid date")
+		}
+		q.DateFrom = to.AddDate(0, 0, 1).Format("2006-01-02")
+	}
+	if (eo.Baseline.From == "" || q.DateTo == "" || q.DateTo >= eo.Baseline.From) &&
+		(eo.Baseline.To == "" || q.DateFrom <= eo.Baseline.To) {
+		return nil, invalidParameter("from", "recent window overlaps the baseline")
+	}
+	if parent, ok := qs["parent"]; ok {
+		eo.Lineage = parent[0]
+	}
+	if eo.Lineage == "" && len(q.Lineages) > 1 {
+		return nil, missingParameter("parent", "parent required with several lineages")
+	}
+	if minCount, ok := qs["minCount"]; ok {
+		i, err := strconv.Atoi(minCount[0])
+		if err != nil {
+			return nil, invalidParameter("minCount", "invalid minCount")
+		}
+		// never report counts that would otherwise be suppressed
+		if i > eo.MinCount {
+			eo.MinCount = i
+		}
+	}
+	if threshold, ok := qs["threshold"]; ok {
+		f, err := strconv.ParseFloat(threshold[0], 64)
+		if err != nil || f <= 0 {
+			return nil, invalidParameter("threshold", "invalid threshold")
+		}
+		eo.ZThreshold = f
+	}
+
+	return &eo, nil
+}
+
+func parseExplain(qs url.Values) (bool, error) {
+	switch qs.Get("explain") {
+	case "", "false":
+		return false, nil
+	case "true":
+		return true, nil
+	}
+	return false, invalidParameter("explain", "explain must be true or false")
+}
+
+func parseAreaLevel(qs url.Values, opts *Opts) (string, error) {
+	level, ok := qs["areaLevel"]
+	if !ok || len(level[0]) == 0 {
+		return "", nil
+	}
+	if opts.AreaHierarchy == nil || !opts.AreaHierarchy.HasLevel(level[0]) {
+		return "", invalidParameter("areaLevel", "unknown area level")
+	}
+	return level[0], nil
+}
+
+func parseBreakdown(qs url.Values, opts *Opts) (covince.Dimension, error) {
+	breakdown, ok := qs["breakdown"]
+	if !ok || len(breakdown[0]) == 0 {
+		return nil, nil
+	}
+	if breakdown[0] == "area" {
+		return covince.AreaDimension, nil
+	}
+	for i, c := range opts.MetadataColumns {
+		if c == breakdown[0] {
+			return covince.MetadataDimension(i), nil
+		}
+	}
+	return nil, invalidParameter("breakdown", "invalid breakdown")
+}
+
+func parseNormalise(qs url.Values, opts *Opts) (bool, bool, error) {
+	normalise, ok := qs["normalise"]
+	if !ok || len(normalise[0]) == 0 {
+		return false, false, nil
+	}
+	byPopulation := false
+	bySequenced := false
+	for _, n := range strings.Split(normalise[0], ",") {
+		if n == "population" {
+			if opts.Population == nil {
+				return false, false, unavailable("normalise", "population not available")
+			}
+			byPopulation = true
+		} else if n == "sequenced" {
+			bySequenced = true
+		} else {
+			return false, false, invalidParameter("normalise", "invalid normalise option: %v", n)
+		}
+	}
+	return byPopulation, bySequenced, nil
+}
+
+type spatiotemporalOpts struct {
+	AreaLevel    string
+	ByPopulation bool
+	BySequenced  bool
+	GeoJSON      bool
+}
+
+func parseSpatiotemporalOptions(qs url.Values, opts *Opts) (*spatiotemporalOpts, error) {
+	var so spatiotemporalOpts
+	var err error
+	so.AreaLevel, err = parseAreaLevel(qs, opts)
+	if err != nil {
+		return nil, err
+	}
+	so.ByPopulation, so.BySequenced, err = parseNormalise(qs, opts)
+	if err != nil {
+		return nil, err
+	}
+	if format, ok := qs["format"]; ok && len(format[0]) > 0 {
+		if format[0] != "geojson" {
+			return nil, invalidParameter("format", "invalid format")
+		}
+		if opts.Boundaries == nil {
+			return nil, unavailable("format", "boundaries not available")
+		}
+		so.GeoJSON = true
+	}
+	return &so, nil
+}
+
+func parseGroupBy(qs url.Values, q *covince.Query, opts *Opts) ([]covince.GroupBy, error) {
+	groupBy, ok := qs["groupBy"]
+	if !ok || len(groupBy[0]) == 0 {
+		return nil, missingParameter("groupBy", "groupBy required")
+	}
+	names := strings.Split(groupBy[0], ",")
+	if len(names) > covince.MAX_GROUP_BY {
+		return nil, invalidParameter("groupBy", "too many groupBy dimensions, maximum is %v", covince.MAX_GROUP_BY)
+	}
+	groups := make([]covince.GroupBy, len(names))
+	for i, name := range names {
+		split := strings.SplitN(name, ":", 2)
+		g := covince.GroupBy{Name: split[0]}
+		if split[0] != "date" && len(split) > 1 {
+			return nil, invalidParameter("groupBy", "invalid groupBy: %v", name)
+		}
+		switch split[0] {
+		case "date":
+			bin := ""
+			if len(split) > 1 {
+				bin = split[1]
+			}
+			d, err := covince.DateBin(bin)
+			if err != nil {
+				return nil, invalidParameter("groupBy", "%v", err)
+			}
+			g.Dimension = d
+		case "area":
+			g.Dimension = covince.AreaDimension
+		case "lineage":
+			if len(q.Lineages) == 0 {
+				return nil, missingParameter("lineages", "lineages required to group by lineage")
+			}
+			g.Kind = covince.GROUP_BY_LINEAGE
+		case "mutation":
+			g.Kind = covince.GROUP_BY_MUTATION
+		case "gene":
+			g.Kind = covince.GROUP_BY_GENE
+		default:
+			for j, c := range opts.MetadataColumns {
+				if c == split[0] {
+					g.Dimension = covince.MetadataDimension(j)
+				}
+			}
+			if g.Dimension == nil {
+				return nil, invalidParameter("groupBy", "invalid groupBy: %v", name)
+			}
+		}
+		groups[i] = g
+	}
+	return groups, nil
+}
@@ -0,0 +1,178 @@
+package covince
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MAX_GROUP_BY = 3
+
+const (
+	GROUP_BY_DIMENSION = iota
+	GROUP_BY_LINEAGE
+	GROUP_BY_MUTATION
+	GROUP_BY_GENE
+)
+
+type GroupBy struct {
+	Name      string
+	Kind      int
+	Dimension Dimension
+}
+
+type AggregateRow struct {
+	Keys  []string
+	Count int
+}
+
+type AggregateIndex map[string]*AggregateRow
+
+type Table struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+const DATE_FORMAT = "2006-01-02"
+
+// DateBin groups dates by "day", "week" (starting Monday) or "month".
+func DateBin(bin string) (Dimension, error) {
+	switch bin {
+	case "", "day":
+		return func(r *Record) string { return r.Date.Value }, nil
+	case "month":
+		return func(r *Record) string { return r.Date.Value[:7] }, nil
+	case "week":
+		var cache sync.Map
+		return func(r *Record) string {
+			if week, ok := cache.Load(r.Date.Value); ok {
+				return week.(string)
+			}
+			week := r.Date.Value
+			if t, err := time.Parse(DATE_FORMAT, r.Date.Value); err == nil {
+				offset := (int(t.Weekday()) + 6) % 7
+				week = t.AddDate(0, 0, -offset).Format(DATE_FORMAT)
+			}
+			cache.Store(r.Date.Value, week)
+			return week
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid date bin: %v", bin)
+}
+
+func mutationKeys(r *Record, q *Query) []string {
+	keys := []string{}
+	for _, rm := range r.Mutations {
+		if (q.Prefix == "" || q.Prefix == rm.Prefix) && (q.SuffixFilter == "" || strings.Contains(rm.Suffix, q.SuffixFilter)) {
+			keys = append(keys, rm.Key)
+		}
+	}
+	return keys
+}
+
+func geneKeys(r *Record, q *Query) []string {
+	keys := []string{}
+	seen := make(map[string]bool)
+	for _, rm := range r.Mutations {
+		if (q.Prefix == "" || q.Prefix == rm.Prefix) && !seen[rm.Prefix] {
+			seen[rm.Prefix] = true
+			keys = append(keys, rm.Prefix)
+		}
+	}
+	return keys
+}
+
+func (i AggregateIndex) add(keys []string, count int) {
+	k := strings.Join(keys, "\x00")
+	if row, ok := i[k]; ok {
+		row.Count += count
+	} else {
+		i[k] = &AggregateRow{Keys: append([]string{}, keys...), Count: count}
+	}
+}
+
+func Aggregate(i AggregateIndex, q *Query, groups []GroupBy, r *Record) {
+	if !matchMetadata(r, q) {
+		return
+	}
+	if ok, _ := matchLineages(r, q.Excluding); ok {
+		return
+	}
+	lineage := ""
+	if len(q.Lineages) > 0 {
+		var ok bool
+		if ok, lineage = matchLineages(r, q.Lineages); !ok {
+			return
+		}
+	}
+
+	keys := make([][]string, len(groups))
+	for j, g := range groups {
+		switch g.Kind {
+		case GROUP_BY_LINEAGE:
+			keys[j] = []string{lineage}
+		case GROUP_BY_MUTATION:
+			keys[j] = mutationKeys(r, q)
+		case GROUP_BY_GENE:
+			keys[j] = geneKeys(r, q)
+		default:
+			keys[j] = []string{g.Dimension(r)}
+		}
+		if len(keys[j]) == 0 {
+			return
+		}
+	}
+
+	// a record with several mutations contributes to a row for each one
+	row := make([]string, len(groups))
+	var expand func(j int)
+	expand = func(j int) {
+		if j == len(groups) {
+			i.add(row, r.Count)
+			return
+		}
+		for _, k := range keys[j] {
+			row[j] = k
+			expand(j + 1)
+		}
+	}
+	expand(0)
+}
+
+func (i AggregateIndex) Suppress(min int) AggregateIndex {
+	for k, row := range i {
+		if row.Count < min {
+			delete(i, k)
+		}
+	}
+	return i
+}
+
+func (i AggregateIndex) Table(groups []GroupBy) Table {
+	t := Table{
+		Columns: make([]string, len(groups)+1),
+		Rows:    make([][]interface{}, 0, len(i)),
+	}
+	for j, g := range groups {
+		t.Columns[j] = g.Name
+	}
+	t.Columns[len(groups)] = "count"
+
+	keys := make([]string, 0, len(i))
+	for k := range i {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		row := i[k]
+		values := make([]interface{}, len(row.Keys)+1)
+		for j, v := range row.Keys {
+			values[j] = v
+		}
+		values[len(row.Keys)] = row.Count
+		t.Rows = append(t.Rows, values)
+	}
+	return t
+}
@@ -0,0 +1,78 @@
+package covince
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDateBin(t *testing.T) {
+	r := Record{Date: value("2021-01-07")}
+	week, _ := DateBin("week")
+	assert.Equal(t, "2021-01-04", week(&r))
+	assert.Equal(t, "2021-01-04", week(&r))
+	month, _ := DateBin("month")
+	assert.Equal(t, "2021-01", month(&r))
+	_, err := DateBin("year")
+	assert.Error(t, err)
+}
+
+func TestAggregate(t *testing.T) {
+	date, _ := DateBin("month")
+
+	t.Run("by date and area", func(t *testing.T) {
+		i := AggregateIndex{}
+		q := Query{}
+		groups := []GroupBy{
+			{Name: "date", Dimension: date},
+			{Name: "area", Dimension: AreaDimension},
+		}
+		for _, r := range testRecords {
+			Aggregate(i, &q, groups, &r)
+		}
+		assert.Equal(t, Table{
+			Columns: []string{"date", "area", "count"},
+			Rows: [][]interface{}{
+				{"2020-09", "A", 1},
+				{"2020-10", "B", 2},
+				{"2020-11", "C", 3},
+			},
+		}, i.Table(groups))
+	})
+
+	t.Run("by lineage and mutation", func(t *testing.T) {
+		i := AggregateIndex{}
+		q := Query{
+			Lineages: []QueryLineage{
+				{Key: "B.1", PangoClade: "B.1."},
+				{Key: "B", PangoClade: "B."},
+			},
+		}
+		groups := []GroupBy{
+			{Name: "lineage", Kind: GROUP_BY_LINEAGE},
+			{Name: "mutation", Kind: GROUP_BY_MUTATION},
+		}
+		for _, r := range testRecords {
+			Aggregate(i, &q, groups, &r)
+		}
+		assert.Equal(t, [][]interface{}{
+			{"B", "A:A", 1},
+			{"B.1", "A:A", 5},
+			{"B.1", "B:B", 5},
+			{"B.1", "C:C", 3},
+		}, i.Table(groups).Rows)
+
+		i.Suppress(4)
+		assert.Len(t, i, 2)
+	})
+
+	t.Run("by gene with filters", func(t *testing.T) {
+		i := AggregateIndex{}
+		q := Query{Area: "C", Prefix: "B"}
+		groups := []GroupBy{{Name: "gene", Kind: GROUP_BY_GENE}}
+		for _, r := range testRecords {
+			Aggregate(i, &q, groups, &r)
+		}
+		assert.Equal(t, [][]interface{}{{"B", 3}}, i.Table(groups).Rows)
+	})
+}
@@ -0,0 +1,117 @@
+package covince
+
+import (
+	"fmt"
+	"strings"
+)
+
+const AREA_LEVEL_SEPARATOR = ":"
+
+type AreaHierarchy struct {
+	Levels      []string
+	ancestors   map[string][]string
+	descendants []map[string]map[string]bool
+}
+
+func CreateAreaHierarchy(levels []string) *AreaHierarchy {
+	h := &AreaHierarchy{
+		Levels:      levels,
+		ancestors:   make(map[string][]string),
+		descendants: make([]map[string]map[string]bool, len(levels)),
+	}
+	for i := range levels {
+		h.descendants[i] = make(map[string]map[string]bool)
+	}
+	return h
+}
+
+func (h *AreaHierarchy) levelIndex(level string) int {
+	for i, l := range h.Levels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+func (h *AreaHierarchy) HasLevel(level string) bool {
+	return h.levelIndex(level) != -1
+}
+
+// AddArea registers a base area, path[0], along with its ancestor at each
+// of the subsequent levels.
+func (h *AreaHierarchy) AddArea(path []string) error {
+	if len(path) != len(h.Levels) {
+		return fmt.Errorf("expected %v levels for area %v, got %v", len(h.Levels), path[0], len(path))
+	}
+	area := path[0]
+	if _, ok := h.ancestors[area]; ok {
+		return fmt.Errorf("duplicate area: %v", area)
+	}
+	h.ancestors[area] = path
+	for i, name := range path {
+		areas, ok := h.descendants[i][name]
+		if !ok {
+			areas = make(map[string]bool)
+			h.descendants[i][name] = areas
+		}
+		areas[area] = true
+	}
+	return nil
+}
+
+// HasArea reports whether the named area is at the given level.
+func (h *AreaHierarchy) HasArea(level string, name string) bool {
+	i := h.levelIndex(level)
+	if i == -1 {
+		return false
+	}
+	_, ok := h.descendants[i][name]
+	return ok
+}
+
+// Ancestor returns the name of the area containing the base area at the
+// given level, or an empty string if the base area is not in the hierarchy.
+func (h *AreaHierarchy) Ancestor(area string, level string) string {
+	i := h.levelIndex(level)
+	path, ok := h.ancestors[area]
+	if i == -1 || !ok {
+		return ""
+	}
+	return path[i]
+}
+
+// Resolve returns the set of base areas within a "level:name" area string.
+func (h *AreaHierarchy) Resolve(s string) (map[string]bool, error) {
+	split := strings.SplitN(s, AREA_LEVEL_SEPARATOR, 2)
+	if len(split) != 2 {
+		return nil, fmt.Errorf("area is not of the form level%vname: %v", AREA_LEVEL_SEPARATOR, s)
+	}
+	i := h.levelIndex(split[0])
+	if i == -1 {
+		return nil, fmt.Errorf("unknown area level: %v", split[0])
+	}
+	areas, ok := h.descendants[i][split[1]]
+	if !ok {
+		return nil, fmt.Errorf("unknown area: %v", s)
+	}
+	return areas, nil
+}
+
+// RollUp sums the area counts of an index into their ancestors at the given
+// level. Areas missing from the hierarchy are dropped.
+func (h *AreaHierarchy) RollUp(i Index, level string) Index {
+	rolled := make(Index)
+	for date, areaCounts := range i {
+		dateCounts := make(map[string]int)
+		for area, count := range areaCounts {
+			if ancestor := h.Ancestor(area, level); ancestor != "" {
+				dateCounts[ancestor] += count
+			}
+		}
+		if len(dateCounts) > 0 {
+			rolled[date] = dateCounts
+		}
+	}
+	return rolled
+}
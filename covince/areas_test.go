@@ -0,0 +1,71 @@
+package covince
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testHierarchy() *AreaHierarchy {
+	h := CreateAreaHierarchy([]string{"ltla", "region", "nation"})
+	h.AddArea([]string{"A", "North", "England"})
+	h.AddArea([]string{"B", "North", "England"})
+	h.AddArea([]string{"C", "South", "England"})
+	return h
+}
+
+func TestAddArea(t *testing.T) {
+	h := testHierarchy()
+	assert.Error(t, h.AddArea([]string{"A", "North", "England"}))
+	assert.Error(t, h.AddArea([]string{"D", "North"}))
+	assert.Equal(t, "North", h.Ancestor("B", "region"))
+	assert.Equal(t, "England", h.Ancestor("C", "nation"))
+	assert.Equal(t, "", h.Ancestor("D", "region"))
+	assert.True(t, h.HasArea("region", "South"))
+	assert.False(t, h.HasArea("region", "A"))
+	assert.False(t, h.HasArea("county", "South"))
+}
+
+func TestResolve(t *testing.T) {
+	h := testHierarchy()
+	areas, err := h.Resolve("region:North")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"A": true, "B": true}, areas)
+
+	areas, err = h.Resolve("ltla:C")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]bool{"C": true}, areas)
+
+	_, err = h.Resolve("county:North")
+	assert.Error(t, err)
+	_, err = h.Resolve("region:East")
+	assert.Error(t, err)
+}
+
+func TestRollUp(t *testing.T) {
+	h := testHierarchy()
+	i := Index{
+		"2020-09-01": {"A": 1, "B": 2, "C": 3},
+		"2020-10-01": {"D": 4},
+	}
+	assert.Equal(t, Index{
+		"2020-09-01": {"North": 3, "South": 3},
+	}, h.RollUp(i, "region"))
+	assert.Equal(t, Index{
+		"2020-09-01": {"England": 6},
+	}, h.RollUp(i, "nation"))
+}
+
+func TestAreaSet(t *testing.T) {
+	h := testHierarchy()
+	m := map[string]int{}
+	areas, _ := h.Resolve("region:North")
+	q := Query{AreaSet: areas}
+	for _, r := range testRecords {
+		Lineages(m, &q, &r)
+	}
+	assert.Equal(t, map[string]int{
+		"B.":   1,
+		"B.1.": 2,
+	}, m)
+}
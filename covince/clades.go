@@ -0,0 +1,132 @@
+package covince
+
+import "sort"
+
+// an index is only used when it narrows the scan to at most this share of
+// the records, as merging larger lists costs more than scanning
+const MAX_INDEX_SELECTIVITY = 0.25
+
+// CladeIndex ranks clades in lexicographic order, which is a pre-order of
+// the lineage tree: the descendants of a clade follow it contiguously, so
+// prefix matching becomes a check that a rank is within a range.
+type CladeIndex struct {
+	Clades []string
+	// sorted record ids for each clade rank
+	Records [][]uint32
+	// rank of each value id, or -1 if the value is not a clade
+	ranks []int32
+}
+
+func CreateCladeIndex(s *ColumnStore) *CladeIndex {
+	c := &CladeIndex{ranks: make([]int32, len(s.db.Values))}
+	for i := range c.ranks {
+		c.ranks[i] = -1
+	}
+	seen := make(map[uint32]bool)
+	for _, id := range s.PangoClades {
+		if !seen[id] {
+			seen[id] = true
+			c.Clades = append(c.Clades, s.value(id))
+		}
+	}
+	sort.Strings(c.Clades)
+	for rank, clade := range c.Clades {
+		c.ranks[s.db.ValueLookup[clade]] = int32(rank)
+	}
+	c.Records = make([][]uint32, len(c.Clades))
+	for i, id := range s.PangoClades {
+		rank := c.ranks[id]
+		c.Records[rank] = append(c.Records[rank], uint32(i))
+	}
+	return c
+}
+
+// Range returns the ranks of the clades that start with prefix.
+func (c *CladeIndex) Range(prefix string) (int32, int32) {
+	from := sort.SearchStrings(c.Clades, prefix)
+	to := from + sort.Search(len(c.Clades)-from, func(i int) bool {
+		clade := c.Clades[from+i]
+		return len(clade) < len(prefix) || clade[:len(prefix)] != prefix
+	})
+	return int32(from), int32(to)
+}
+
+// Resolve gives the lineages of q the ranges of their clades, so that
+// records of the planner's store are matched by rank rather than prefix.
+func (p *Planner) Resolve(q *Query) {
+	if p.Clades == nil {
+		return
+	}
+	for _, lineages := range [][]QueryLineage{q.Lineages, q.Excluding} {
+		for i := range lineages {
+			ql := &lineages[i]
+			ql.db, ql.ranks = p.Store.db, p.Clades.ranks
+			ql.from, ql.to = p.Clades.Range(ql.PangoClade)
+		}
+	}
+}
+
+func (c *CladeIndex) inRange(valueId uint32, from int32, to int32) bool {
+	rank := c.ranks[valueId]
+	return rank >= from && rank < to
+}
+
+// withinClades keeps the records whose clade is within the range.
+func (s *ColumnStore) withinClades(c *CladeIndex, ids []uint32, from int32, to int32) []uint32 {
+	result := make([]uint32, 0, len(ids))
+	for _, id := range ids {
+		if c.inRange(s.PangoClades[id], from, to) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// inClades returns the sorted ids of the records whose clade is within the
+// range, or false if there are too many for the index to be worthwhile.
+func (s *ColumnStore) inClades(c *CladeIndex, from int32, to int32) ([]uint32, bool) {
+	n := 0
+	for _, records := range c.Records[from:to] {
+		n += len(records)
+	}
+	if float64(n) > MAX_INDEX_SELECTIVITY*float64(s.Len()) {
+		return nil, false
+	}
+	ids := make([]uint32, 0, n)
+	for _, records := range c.Records[from:to] {
+		ids = append(ids, records...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, true
+}
+
+// candidates returns the ids of the records that can match at least one of
+// the lineages, using whichever indexes are given. It returns false when a
+// lineage cannot be narrowed, as the whole store must then be scanned.
+func (s *ColumnStore) candidates(idx *MutationIndex, c *CladeIndex, lineages []QueryLineage) ([]uint32, bool) {
+	if len(lineages) == 0 {
+		return nil, false
+	}
+	var candidates []uint32
+	for i := range lineages {
+		ql := &lineages[i]
+		var ids []uint32
+		if idx != nil && len(ql.Mutations) > 0 {
+			ids = idx.withMutations(ql)
+			if c != nil {
+				from, to := c.Range(ql.PangoClade)
+				ids = s.withinClades(c, ids, from, to)
+			}
+		} else if c != nil {
+			from, to := c.Range(ql.PangoClade)
+			var ok bool
+			if ids, ok = s.inClades(c, from, to); !ok {
+				return nil, false
+			}
+		} else {
+			return nil, false
+		}
+		candidates = union(candidates, ids)
+	}
+	return candidates, true
+}
@@ -0,0 +1,118 @@
+package covince
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCladeRange(t *testing.T) {
+	c := &CladeIndex{Clades: []string{"A.", "B.", "B.1.", "B.1.1.7.", "B.10.", "B.2.", "C."}}
+	ranges := map[string][]int32{
+		"B.":    {1, 6},
+		"B.1.":  {2, 4},
+		"B.10.": {4, 5},
+		"A.":    {0, 1},
+		"C.1.":  {7, 7},
+		"":      {0, 7},
+	}
+	for prefix, expected := range ranges {
+		from, to := c.Range(prefix)
+		assert.Equal(t, expected, []int32{from, to}, prefix)
+	}
+}
+
+func TestCladeIndex(t *testing.T) {
+	db := testDatabase(2000)
+	s := testColumnStore(db)
+	s.Partition()
+	c := CreateCladeIndex(s)
+	idx := CreateMutationIndex(s)
+	assert.Equal(t, []string{"A.", "B.", "B.1.", "B.1.1.7."}, c.Clades)
+
+	t.Run("too many records to be worthwhile", func(t *testing.T) {
+		_, ok := s.Select(nil, c, &Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}, 1)
+		assert.False(t, ok)
+	})
+
+	for _, q := range []Query{
+		{Lineages: []QueryLineage{{Key: "B.1.1.7", PangoClade: "B.1.1.7."}, {Key: "A", PangoClade: "A."}}},
+		{Lineages: []QueryLineage{
+			{Key: "B.1+N:A", PangoClade: "B.1.", Mutations: []Mutation{{Prefix: "N", Suffix: "A"}}},
+			{Key: "A", PangoClade: "A."},
+		}},
+	} {
+		q := q
+		newPartial := func() Partial {
+			return NewIndexPartial(func(i Index, r *Record) { Frequency(i, &q, r) })
+		}
+		expected, _ := MapReduce(context.Background(), s.Scan(1), 1, newPartial)
+
+		ids, ok := s.candidates(idx, c, q.Lineages)
+		assert.True(t, ok)
+		assert.True(t, len(ids) <= s.Len()/2)
+		scan, ok := s.Select(idx, c, &q, 2)
+		assert.True(t, ok)
+		actual, err := MapReduce(context.Background(), scan, 2, newPartial)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, expected.(*IndexPartial).Index)
+		assert.Equal(t, expected.(*IndexPartial).Index, actual.(*IndexPartial).Index)
+	}
+}
+
+func TestResolveLineages(t *testing.T) {
+	s := testColumnStore(testDatabase(2000))
+	p := &Planner{Store: s, Clades: CreateCladeIndex(s)}
+	q := Query{
+		Lineages:  []QueryLineage{{Key: "B.1", PangoClade: "B.1."}, {Key: "A", PangoClade: "A."}},
+		Excluding: []QueryLineage{{Key: "B.1.1.7", PangoClade: "B.1.1.7."}},
+	}
+	count := func(s *ColumnStore, q *Query) map[string]int {
+		m := make(map[string]int)
+		s.Scan(1)(context.Background(), func(r *Record) {
+			if ok, key := matchLineages(r, q.Lineages); ok {
+				m[key] += r.Count
+			}
+		}, -1)
+		return m
+	}
+	expected := count(s, &q)
+	p.Resolve(&q)
+	assert.Equal(t, []int32{2, 4}, []int32{q.Lineages[0].from, q.Lineages[0].to})
+	assert.Equal(t, []int32{3, 4}, []int32{q.Excluding[0].from, q.Excluding[0].to})
+	assert.Equal(t, expected, count(s, &q))
+
+	// resolved lineages are matched by rank alone
+	q.Lineages[1].to = q.Lineages[1].from
+	assert.NotContains(t, count(s, &q), "A")
+
+	t.Run("records of another database match by prefix", func(t *testing.T) {
+		assert.Contains(t, count(testColumnStore(testDatabase(2000)), &q), "A")
+	})
+}
+
+var benchmarkCladeQuery = Query{Lineages: []QueryLineage{{Key: "A", PangoClade: "A."}}}
+
+func BenchmarkCladeFullScan(b *testing.B) {
+	s := testColumnStore(testDatabase(BENCHMARK_RECORDS))
+	s.Partition()
+	scan := s.Scan(1)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := make(Index)
+		scan(context.Background(), func(r *Record) { Frequency(i, &benchmarkCladeQuery, r) }, -1)
+	}
+}
+
+func BenchmarkCladeIndexScan(b *testing.B) {
+	s := testColumnStore(testDatabase(BENCHMARK_RECORDS))
+	s.Partition()
+	c := CreateCladeIndex(s)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := make(Index)
+		scan, _ := s.Select(nil, c, &benchmarkCladeQuery, 1)
+		scan(context.Background(), func(r *Record) { Frequency(i, &benchmarkCladeQuery, r) }, -1)
+	}
+}
@@ -0,0 +1,176 @@
+package covince
+
+import (
+	"context"
+	"math/bits"
+	"sort"
+	"unsafe"
+)
+
+// ColumnStore holds records as columns of ids into the database's values
+// and mutations, which is far smaller than a slice of Record and has no
+// pointers for the garbage collector to scan. The mutations of record i are
+// MutationIds[MutationOffsets[i]:MutationOffsets[i+1]], and it is skipped if
+// its bit is set in Deleted.
+type ColumnStore struct {
+	db              *Database
+	Dates           []uint32
+	Areas           []uint32
+	PangoClades     []uint32
+	Metadata        [][]uint32
+	MutationOffsets []uint32
+	MutationIds     []uint32
+	Counts          []int32
+	Deleted         []uint64
+	Partitions      []Partition
+}
+
+func CreateColumnStore(db *Database) *ColumnStore {
+	return &ColumnStore{
+		db:              db,
+		Metadata:        make([][]uint32, len(db.Columns)),
+		MutationOffsets: []uint32{0},
+	}
+}
+
+func (s *ColumnStore) Len() int {
+	return len(s.Counts)
+}
+
+func isSet(bits []uint64, i int) bool {
+	return i>>6 < len(bits) && bits[i>>6]&(1<<(i&63)) != 0
+}
+
+func (s *ColumnStore) isDeleted(i int) bool {
+	return isSet(s.Deleted, i)
+}
+
+func (s *ColumnStore) deletedCount() int {
+	n := 0
+	for _, word := range s.Deleted {
+		n += bits.OnesCount64(word)
+	}
+	return n
+}
+
+func (s *ColumnStore) setDeleted(i int, deleted bool) {
+	for i>>6 >= len(s.Deleted) {
+		s.Deleted = append(s.Deleted, 0)
+	}
+	if deleted {
+		s.Deleted[i>>6] |= 1 << (i & 63)
+	} else {
+		s.Deleted[i>>6] &^= 1 << (i & 63)
+	}
+}
+
+func (s *ColumnStore) valueId(v *Value) uint32 {
+	return uint32(s.db.ValueLookup[v.Value])
+}
+
+// Append adds a record whose values and mutations were indexed by the
+// database, so it must be called before MutationLookup is cleared. The ids
+// of the mutations are sorted, so that the same set is always stored alike.
+func (s *ColumnStore) Append(r *Record) {
+	s.Dates = append(s.Dates, s.valueId(r.Date))
+	s.Areas = append(s.Areas, s.valueId(r.Area))
+	s.PangoClades = append(s.PangoClades, s.valueId(r.PangoClade))
+	for i, v := range r.Metadata {
+		s.Metadata[i] = append(s.Metadata[i], s.valueId(v))
+	}
+	from := len(s.MutationIds)
+	for _, m := range r.Mutations {
+		s.MutationIds = append(s.MutationIds, uint32(s.db.MutationLookup[m.Key]))
+	}
+	ids := s.MutationIds[from:]
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	s.MutationOffsets = append(s.MutationOffsets, uint32(len(s.MutationIds)))
+	s.Counts = append(s.Counts, int32(r.Count))
+}
+
+// decoder materialises rows into a Record that is reused for every row, so
+// aggregators must not keep a reference to it.
+type decoder struct {
+	s         *ColumnStore
+	values    []Value
+	mutations []Mutation
+	r         Record
+	muts      []*Mutation
+}
+
+func (s *ColumnStore) decoder() *decoder {
+	return &decoder{
+		s:         s,
+		values:    s.db.Values,
+		mutations: s.db.Mutations,
+		r:         Record{Metadata: make([]*Value, len(s.Metadata)), db: s.db},
+	}
+}
+
+func (d *decoder) decode(i int) *Record {
+	s, values, r := d.s, d.values, &d.r
+	r.Date = &values[s.Dates[i]]
+	r.Area = &values[s.Areas[i]]
+	r.PangoClade = &values[s.PangoClades[i]]
+	r.cladeId = s.PangoClades[i]
+	for j, column := range s.Metadata {
+		r.Metadata[j] = &values[column[i]]
+	}
+	d.muts = d.muts[:0]
+	for _, id := range s.MutationIds[s.MutationOffsets[i]:s.MutationOffsets[i+1]] {
+		d.muts = append(d.muts, &d.mutations[id])
+	}
+	r.Mutations = d.muts
+	r.Count = int(s.Counts[i])
+	return r
+}
+
+// Iterate decodes records from and up to but excluding to, skipping deleted
+// ones.
+func (s *ColumnStore) Iterate(ctx context.Context, from int, to int, aggregationFunc func(r *Record)) error {
+	d := s.decoder()
+	for i := from; i < to; i++ {
+		if (i-from)%CANCEL_CHECK_INTERVAL == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if s.Deleted == nil || !s.isDeleted(i) {
+			aggregationFunc(d.decode(i))
+		}
+	}
+	return ctx.Err()
+}
+
+// IterateIds decodes only the given records that are not deleted.
+func (s *ColumnStore) IterateIds(ctx context.Context, ids []uint32, aggregationFunc func(r *Record)) error {
+	d := s.decoder()
+	for j, id := range ids {
+		if j%CANCEL_CHECK_INTERVAL == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		if s.Deleted == nil || !s.isDeleted(int(id)) {
+			aggregationFunc(d.decode(int(id)))
+		}
+	}
+	return ctx.Err()
+}
+
+// Scan iterates the store split into the given number of slices.
+func (s *ColumnStore) Scan(slices int) ContextIteratorFunc {
+	return func(ctx context.Context, aggregationFunc func(r *Record), sliceIndex int) error {
+		from, to := SliceBounds(s.Len(), sliceIndex, slices)
+		return s.Iterate(ctx, from, to, aggregationFunc)
+	}
+}
+
+// Size is the number of bytes held by the columns.
+func (s *ColumnStore) Size() int {
+	ids := len(s.Dates) + len(s.Areas) + len(s.PangoClades) + len(s.MutationOffsets) + len(s.MutationIds)
+	for _, column := range s.Metadata {
+		ids += len(column)
+	}
+	return ids*int(unsafe.Sizeof(uint32(0))) + len(s.Counts)*int(unsafe.Sizeof(int32(0))) + len(s.Deleted)*int(unsafe.Sizeof(uint64(0)))
+}
@@ -0,0 +1,149 @@
+package covince
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDatabase(n int) *Database {
+	db := CreateDatabase()
+	db.Columns = []string{"sampleType"}
+	for i := 0; i < n; i++ {
+		muts := []string{fmt.Sprintf("S:%v", i%50)}
+		if i%3 == 0 {
+			muts = append(muts, "N:A", fmt.Sprintf("ORF1a:%v", i%7))
+		}
+		db.Records = append(db.Records, Record{
+			Metadata:   db.IndexMetadata([]string{[]string{"hospital", "community"}[i%2]}),
+			Date:       db.IndexValue(fmt.Sprintf("2021-01-%02d", i%28+1)),
+			Area:       db.IndexValue(fmt.Sprintf("E%v", i%300)),
+			PangoClade: db.IndexValue([]string{"B.", "B.1.", "B.1.1.7.", "A."}[i%4]),
+			Mutations:  db.IndexMutations(muts, ":"),
+			Count:      i%5 + 1,
+		})
+	}
+	return db
+}
+
+func testColumnStore(db *Database) *ColumnStore {
+	s := CreateColumnStore(db)
+	for i := range db.Records {
+		s.Append(&db.Records[i])
+	}
+	return s
+}
+
+func TestColumnStore(t *testing.T) {
+	db := testDatabase(100)
+	s := testColumnStore(db)
+	assert.Equal(t, 100, s.Len())
+
+	i := 0
+	err := s.Iterate(context.Background(), 0, s.Len(), func(r *Record) {
+		expected := db.Records[i]
+		assert.Equal(t, expected.Date.Value, r.Date.Value)
+		assert.Equal(t, expected.Area.Value, r.Area.Value)
+		assert.Equal(t, expected.PangoClade.Value, r.PangoClade.Value)
+		assert.Equal(t, expected.Metadata[0].Value, r.Metadata[0].Value)
+		assert.ElementsMatch(t, expected.Mutations, r.Mutations)
+		assert.Equal(t, expected.Count, r.Count)
+		i++
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, i)
+
+	q := Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}
+	newPartial := func() Partial {
+		return NewIndexPartial(func(i Index, r *Record) { Frequency(i, &q, r) })
+	}
+	expected, _ := MapReduce(context.Background(), testScan(db.Records, 1), 1, newPartial)
+	actual, err := MapReduce(context.Background(), s.Scan(3), 3, newPartial)
+	assert.Nil(t, err)
+	assert.Equal(t, expected.(*IndexPartial).Index, actual.(*IndexPartial).Index)
+}
+
+const BENCHMARK_RECORDS = 2000000
+
+func BenchmarkRecordScan(b *testing.B) {
+	db := testDatabase(BENCHMARK_RECORDS)
+	scan := testScan(db.Records, 1)
+	q := Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}
+	runtime.GC()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		m := make(map[string]int)
+		scan(context.Background(), func(r *Record) { Lineages(m, &q, r) }, -1)
+	}
+}
+
+func BenchmarkColumnScan(b *testing.B) {
+	s := testColumnStore(testDatabase(BENCHMARK_RECORDS))
+	scan := s.Scan(1)
+	q := Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}
+	runtime.GC()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		m := make(map[string]int)
+		scan(context.Background(), func(r *Record) { Lineages(m, &q, r) }, -1)
+	}
+}
+
+func heapAlloc() uint64 {
+	var m runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
+
+// reports the heap held by the records alone, excluding the shared values
+func BenchmarkRecordMemory(b *testing.B) {
+	db := testDatabase(BENCHMARK_RECORDS)
+	for n := 0; n < b.N; n++ {
+		before := heapAlloc()
+		records := make([]Record, len(db.Records))
+		for i, r := range db.Records {
+			r.Metadata = append([]*Value{}, r.Metadata...)
+			r.Mutations = append([]*Mutation{}, r.Mutations...)
+			records[i] = r
+		}
+		b.ReportMetric(float64(heapAlloc()-before)/BENCHMARK_RECORDS, "bytes/record")
+		runtime.KeepAlive(records)
+	}
+}
+
+func BenchmarkColumnMemory(b *testing.B) {
+	db := testDatabase(BENCHMARK_RECORDS)
+	for n := 0; n < b.N; n++ {
+		before := heapAlloc()
+		s := testColumnStore(db)
+		b.ReportMetric(float64(heapAlloc()-before)/BENCHMARK_RECORDS, "bytes/record")
+		runtime.KeepAlive(s)
+	}
+}
+
+// reports the time the garbage collector takes to mark the records
+func BenchmarkRecordGC(b *testing.B) {
+	db := testDatabase(BENCHMARK_RECORDS)
+	runtime.GC()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+	}
+	runtime.KeepAlive(db)
+}
+
+func BenchmarkColumnGC(b *testing.B) {
+	db := testDatabase(BENCHMARK_RECORDS)
+	s := testColumnStore(db)
+	db.Records = nil
+	runtime.GC()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		runtime.GC()
+	}
+	runtime.KeepAlive(s)
+}
@@ -1,6 +1,7 @@
 package covince
 
 import (
+	"sort"
 	"strings"
 )
 
@@ -10,16 +11,23 @@ type QueryLineage struct {
 	Key        string
 	PangoClade string
 	Mutations  []Mutation
+	// the ranks of the clades starting with PangoClade, once resolved
+	db       *Database
+	ranks    []int32
+	from, to int32
 }
 
 type Query struct {
-	Lineages     []QueryLineage
-	Excluding    []QueryLineage
-	Area         string
-	DateFrom     string
-	DateTo       string
-	Prefix       string
-	SuffixFilter string
+	Lineages      []QueryLineage
+	Excluding     []QueryLineage
+	Area          string
+	AreaSet       map[string]bool
+	ExcludedAreas map[string]bool
+	Metadata      []MetadataFilter
+	DateFrom      string
+	DateTo        string
+	Prefix        string
+	SuffixFilter  string
 }
 
 type MutationSearch struct {
@@ -32,9 +40,21 @@ type MutationSearch struct {
 
 type IteratorFunc func(aggregationFunc func(r *Record), sliceIndex int)
 
+// matchesClade compares the rank of the record's clade with the lineage's
+// range if both came from the same database, and the clade strings if not.
+func (ql *QueryLineage) matchesClade(r *Record) bool {
+	if ql.db != nil && r.db == ql.db && int(r.cladeId) < len(ql.ranks) {
+		if rank := ql.ranks[r.cladeId]; rank != -1 {
+			return rank >= ql.from && rank < ql.to
+		}
+	}
+	return strings.HasPrefix(r.PangoClade.Value, ql.PangoClade)
+}
+
 func matchLineages(r *Record, lineages []QueryLineage) (bool, string) {
-	for _, ql := range lineages {
-		if strings.HasPrefix(r.PangoClade.Value, ql.PangoClade) {
+	for i := range lineages {
+		ql := &lineages[i]
+		if ql.matchesClade(r) {
 			if len(ql.Mutations) > 0 {
 				hasMuts := true
 				for _, qm := range ql.Mutations {
@@ -64,6 +84,17 @@ func matchMetadata(r *Record, q *Query) bool {
 	if q.Area != "" && q.Area != "overview" && r.Area.Value != q.Area {
 		return false
 	}
+	if q.AreaSet != nil && !q.AreaSet[r.Area.Value] {
+		return false
+	}
+	if q.ExcludedAreas[r.Area.Value] {
+		return false
+	}
+	for _, f := range q.Metadata {
+		if !f.Values[r.Metadata[f.Column].Value] {
+			return false
+		}
+	}
 	if q.DateFrom != "" && r.Date.Value < q.DateFrom {
 		return false
 	}
@@ -86,27 +117,45 @@ func Frequency(i Index, q *Query, r *Record) {
 	}
 }
 
-func Totals(foreach IteratorFunc, q *Query, mutSuppressionMin int) Index {
-	perLineage := make(map[string]Index)
-	for _, ql := range q.Lineages {
-		perLineage[ql.Key] = Index{}
-	}
-
-	foreach(func(r *Record) {
-		if ok, l := matchLineages(r, q.Lineages); ok {
-			i := perLineage[l]
+func FrequencyBy(m map[string]Index, q *Query, d Dimension, r *Record) {
+	if matchMetadata(r, q) {
+		if ok, key := matchLineages(r, q.Lineages); ok {
+			group := d(r)
+			i, ok := m[group]
+			if !ok {
+				i = make(Index)
+				m[group] = i
+			}
 			dateCounts, ok := i[r.Date.Value]
 			if !ok {
 				dateCounts = make(map[string]int)
 				i[r.Date.Value] = dateCounts
 			}
-			dateCounts[r.Area.Value] += r.Count
+			dateCounts[key] += r.Count
 		}
-	}, -1)
+	}
+}
 
+func TotalsByLineage(perLineage map[string]Index, q *Query, r *Record) {
+	if ok, l := matchLineages(r, q.Lineages); ok {
+		i, ok := perLineage[l]
+		if !ok {
+			i = make(Index)
+			perLineage[l] = i
+		}
+		dateCounts, ok := i[r.Date.Value]
+		if !ok {
+			dateCounts = make(map[string]int)
+			i[r.Date.Value] = dateCounts
+		}
+		dateCounts[r.Area.Value] += r.Count
+	}
+}
+
+func SumTotals(perLineage map[string]Index, q *Query, mutSuppressionMin int) Index {
 	if mutSuppressionMin > 0 {
 		for _, ql := range q.Lineages {
-			if len(ql.Mutations) > 0 {
+			if len(ql.Mutations) > 0 && perLineage[ql.Key] != nil {
 				Suppress(perLineage[ql.Key], mutSuppressionMin)
 			}
 		}
@@ -117,17 +166,25 @@ func Totals(foreach IteratorFunc, q *Query, mutSuppressionMin int) Index {
 		for date, areaCounts := range i {
 			dateCounts, ok := totals[date]
 			if !ok {
-				totals[date] = areaCounts
-			} else {
-				for area, count := range areaCounts {
-					dateCounts[area] += count
-				}
+				dateCounts = make(map[string]int)
+				totals[date] = dateCounts
+			}
+			for area, count := range areaCounts {
+				dateCounts[area] += count
 			}
 		}
 	}
 	return totals
 }
 
+func Totals(foreach IteratorFunc, q *Query, mutSuppressionMin int) Index {
+	perLineage := make(map[string]Index)
+	foreach(func(r *Record) {
+		TotalsByLineage(perLineage, q, r)
+	}, -1)
+	return SumTotals(perLineage, q, mutSuppressionMin)
+}
+
 func Spatiotemporal(i Index, q *Query, r *Record) {
 	if ok, _ := matchLineages(r, q.Excluding); ok {
 		return
@@ -148,6 +205,18 @@ func Lineages(m map[string]int, q *Query, r *Record) {
 	}
 }
 
+func LineagesBy(m map[string]map[string]int, q *Query, d Dimension, r *Record) {
+	if matchMetadata(r, q) {
+		group := d(r)
+		counts, ok := m[group]
+		if !ok {
+			counts = make(map[string]int)
+			m[group] = counts
+		}
+		counts[r.PangoClade.Value] += r.Count
+	}
+}
+
 func Mutations(m map[string]*MutationSearch, total *MutationSearch, so *SearchOpts, q *Query, r *Record) {
 	if len(r.Mutations) == 0 {
 		return
@@ -204,5 +273,7 @@ func Info(foreach IteratorFunc) ([]string, []string) {
 		areaArray[i] = k
 		i++
 	}
+	sort.Strings(dateArray)
+	sort.Strings(areaArray)
 	return dateArray, areaArray
 }
@@ -80,6 +80,24 @@ func TestFrequency(t *testing.T) {
 	})
 }
 
+func TestFrequencyBy(t *testing.T) {
+	m := map[string]Index{}
+	q := Query{
+		Lineages: []QueryLineage{
+			{Key: "B", PangoClade: "B."},
+		},
+		AreaSet:       map[string]bool{"A": true, "B": true, "C": true},
+		ExcludedAreas: map[string]bool{"C": true},
+	}
+	for _, r := range testRecords {
+		FrequencyBy(m, &q, AreaDimension, &r)
+	}
+	assert.Equal(t, map[string]Index{
+		"A": {"2020-09-01": {"B": 1}},
+		"B": {"2020-10-01": {"B": 2}},
+	}, m)
+}
+
 func TestTotals(t *testing.T) {
 	var i Index
 	var q Query
@@ -96,7 +114,7 @@ func TestTotals(t *testing.T) {
 				agg(&r)
 			}
 		}
-		Totals(foreach, &q, 0)
+		i = Totals(foreach, &q, 0)
 		assert.Equal(t, Index{
 			"2020-09-01": {"A": 1},
 			"2020-10-01": {"B": 2},
@@ -0,0 +1,28 @@
+package covince
+
+// Cube sums the counts of the records with the same date, area and clade
+// into a store without mutations or metadata, leaving out deleted records.
+// Aggregating the cube gives the same result as the records for any query
+// that involves neither.
+func (s *ColumnStore) Cube() *ColumnStore {
+	cube := &ColumnStore{db: s.db, MutationOffsets: []uint32{0}}
+	cells := make(map[[3]uint32]int)
+	for i := 0; i < s.Len(); i++ {
+		if s.isDeleted(i) {
+			continue
+		}
+		key := [3]uint32{s.Dates[i], s.Areas[i], s.PangoClades[i]}
+		if j, ok := cells[key]; ok {
+			cube.Counts[j] += s.Counts[i]
+			continue
+		}
+		cells[key] = cube.Len()
+		cube.Dates = append(cube.Dates, key[0])
+		cube.Areas = append(cube.Areas, key[1])
+		cube.PangoClades = append(cube.PangoClades, key[2])
+		cube.MutationOffsets = append(cube.MutationOffsets, 0)
+		cube.Counts = append(cube.Counts, s.Counts[i])
+	}
+	cube.Partition()
+	return cube
+}
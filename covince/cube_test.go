@@ -0,0 +1,40 @@
+package covince
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCube(t *testing.T) {
+	s := testColumnStore(testDatabase(3000))
+	cube := s.Cube()
+	assert.True(t, cube.Len() < s.Len())
+	assert.NotEmpty(t, cube.Partitions)
+
+	q := Query{
+		Lineages:  []QueryLineage{{Key: "B.1", PangoClade: "B.1."}, {Key: "B", PangoClade: "B."}},
+		Excluding: []QueryLineage{{Key: "A", PangoClade: "A."}},
+		AreaSet:   map[string]bool{"E1": true, "E2": true, "E3": true},
+		DateFrom:  "2021-01-05",
+	}
+	newPartial := func() Partial {
+		return Partials{
+			NewIndexPartial(func(i Index, r *Record) { Frequency(i, &q, r) }),
+			NewCountsPartial(func(m map[string]int, r *Record) { Lineages(m, &q, r) }),
+			NewGroupedIndexPartial(func(m map[string]Index, r *Record) { TotalsByLineage(m, &q, r) }),
+			NewIndexPartial(func(i Index, r *Record) { Spatiotemporal(i, &q, r) }),
+		}
+	}
+	expected, _ := MapReduce(context.Background(), s.Scan(1), 1, newPartial)
+	actual, err := MapReduce(context.Background(), cube.Scan(2), 2, newPartial)
+	assert.Nil(t, err)
+
+	e, a := expected.(Partials), actual.(Partials)
+	assert.NotEmpty(t, e[0].(*IndexPartial).Index)
+	assert.Equal(t, e[0].(*IndexPartial).Index, a[0].(*IndexPartial).Index)
+	assert.Equal(t, e[1].(*CountsPartial).Counts, a[1].(*CountsPartial).Counts)
+	assert.Equal(t, e[2].(*GroupedIndexPartial).Groups, a[2].(*GroupedIndexPartial).Groups)
+	assert.Equal(t, e[3].(*IndexPartial).Index, a[3].(*IndexPartial).Index)
+}
@@ -9,13 +9,16 @@ type Value struct {
 }
 
 type Record struct {
-	// Metadata *Metadata
-	Date *Value
+	Metadata []*Value
+	Date     *Value
 	// Lineage    string
 	PangoClade *Value
 	Area       *Value
 	Mutations  []*Mutation
 	Count      int
+	// the value id of the clade in db, if decoded from a store
+	db      *Database
+	cladeId uint32
 }
 
 type Mutation struct {
@@ -25,6 +28,7 @@ type Mutation struct {
 }
 
 type Database struct {
+	Columns        []string
 	Count          int
 	Genes          map[string]bool
 	Mutations      []Mutation
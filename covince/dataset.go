@@ -0,0 +1,322 @@
+package covince
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Row is a record as received, before its values are indexed. A deleted row
+// is a tombstone for the record with its key, and has no count.
+type Row struct {
+	Area       string
+	Date       string
+	PangoClade string
+	Metadata   []string
+	Mutations  []string
+	Count      int
+	Deleted    bool
+}
+
+// Version is the data at one point in time, which is never modified once
+// published.
+type Version struct {
+	LastModified int64
+	Planner      *Planner
+}
+
+// Dataset publishes versions of the data. An update is applied to a copy of
+// the current version which then replaces it, so that a query sees the same
+// version throughout. An update is refused if the footprint of its version
+// would exceed Limit bytes, unless Limit is zero.
+type Dataset struct {
+	Limit   int
+	mu      sync.Mutex
+	current atomic.Value
+}
+
+func CreateDataset(p *Planner, lastModified int64) *Dataset {
+	d := &Dataset{}
+	d.current.Store(&Version{LastModified: lastModified, Planner: p})
+	return d
+}
+
+func (d *Dataset) Current() *Version {
+	return d.current.Load().(*Version)
+}
+
+type UpsertResult struct {
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+	Deleted  int `json:"deleted"`
+	// tombstones of keys without a record
+	Missing int `json:"missing"`
+	// records that are not deleted
+	Records      int   `json:"records"`
+	LastModified int64 `json:"lastModified"`
+	// indexes not rebuilt to stay within the memory limit
+	Dropped []string `json:"dropped,omitempty"`
+}
+
+// Database returns the values and mutations that the store's ids refer to.
+func (s *ColumnStore) Database() *Database {
+	return s.db
+}
+
+// clone copies the lookups, so values and mutations can be added without
+// affecting readers of the original.
+func (db *Database) clone() *Database {
+	c := *db
+	c.Genes = make(map[string]bool, len(db.Genes))
+	for k, v := range db.Genes {
+		c.Genes[k] = v
+	}
+	c.ValueLookup = make(map[string]int, len(db.ValueLookup))
+	for k, v := range db.ValueLookup {
+		c.ValueLookup[k] = v
+	}
+	c.MutationLookup = make(map[string]int, len(db.MutationLookup))
+	for k, v := range db.MutationLookup {
+		c.MutationLookup[k] = v
+	}
+	return &c
+}
+
+// clone copies what may be modified in place. Records are only ever
+// appended, beyond the length that readers of the original can see.
+func (s *ColumnStore) clone(db *Database) *ColumnStore {
+	c := *s
+	c.db = db
+	c.Metadata = append([][]uint32(nil), s.Metadata...)
+	c.Counts = append([]int32(nil), s.Counts...)
+	c.Deleted = append([]uint64(nil), s.Deleted...)
+	c.Partitions = append([]Partition(nil), s.Partitions...)
+	return &c
+}
+
+func (s *ColumnStore) mutationIds(i int) []uint32 {
+	return s.MutationIds[s.MutationOffsets[i]:s.MutationOffsets[i+1]]
+}
+
+func appendIds(key []byte, ids ...uint32) []byte {
+	for _, id := range ids {
+		key = append(key, byte(id), byte(id>>8), byte(id>>16), byte(id>>24))
+	}
+	return key
+}
+
+// key identifies a record by its area, date, clade, metadata and set of
+// mutations, whose ids are sorted whatever order they were given in.
+func (s *ColumnStore) key(i int) string {
+	key := appendIds(make([]byte, 0, 64), s.Areas[i], s.Dates[i], s.PangoClades[i])
+	for _, column := range s.Metadata {
+		key = appendIds(key, column[i])
+	}
+	return string(appendIds(key, s.mutationIds(i)...))
+}
+
+func (db *Database) validateRow(row *Row, separator string) error {
+	if len(row.Metadata) != len(db.Columns) {
+		return fmt.Errorf("expected %v metadata values, got %v", len(db.Columns), len(row.Metadata))
+	}
+	for _, m := range row.Mutations {
+		if !strings.Contains(m, separator) {
+			return fmt.Errorf("mutation %q has no separator %q", m, separator)
+		}
+	}
+	return nil
+}
+
+func (db *Database) indexRow(row *Row, separator string) *Record {
+	return &Record{
+		Metadata:   db.IndexMetadata(row.Metadata),
+		Area:       db.IndexValue(row.Area),
+		Date:       db.IndexValue(row.Date),
+		PangoClade: db.IndexValue(row.PangoClade),
+		Mutations:  db.IndexMutations(row.Mutations, separator),
+		Count:      row.Count,
+	}
+}
+
+// existing finds the records with the keys of the delta's dates.
+func (s *ColumnStore) existing(dates []string) map[string]int {
+	sort.Strings(dates)
+	ranges, pruned := s.prune(&Query{DateFrom: dates[0], DateTo: dates[len(dates)-1]})
+	if !pruned {
+		ranges = []recordRange{{0, s.Len()}}
+	}
+	keys := make(map[string]int)
+	for _, r := range ranges {
+		for i := r.from; i < r.to; i++ {
+			keys[s.key(i)] = i
+		}
+	}
+	return keys
+}
+
+// extend returns an index that also covers the records from the given one,
+// whose mutations may be new to the index.
+func (idx *MutationIndex) extend(s *ColumnStore, from int) *MutationIndex {
+	c := &MutationIndex{
+		Postings: append(make([][]uint32, 0, len(s.db.Mutations)), idx.Postings...),
+		lookup:   idx.lookup,
+	}
+	if n := len(idx.Postings); n < len(s.db.Mutations) {
+		c.lookup = make(map[string]uint32, len(s.db.Mutations))
+		for k, v := range idx.lookup {
+			c.lookup[k] = v
+		}
+		for i, m := range s.db.Mutations[n:] {
+			c.lookup[mutationLookupKey(m.Prefix, m.Suffix)] = uint32(n + i)
+		}
+		c.Postings = c.Postings[:len(s.db.Mutations)]
+	}
+	for i := from; i < s.Len(); i++ {
+		for _, id := range s.mutationIds(i) {
+			c.Postings[id] = append(c.Postings[id], uint32(i))
+		}
+	}
+	return c
+}
+
+// Upsert publishes a version with the rows applied in order. A row replaces
+// the count of any record with the same key, and is summed with earlier rows
+// of the delta with that key, while a tombstone deletes the record. Indexes
+// are extended with the new records and the clade index and cube rebuilt.
+// Deleted records keep their place in the store and are skipped when it is
+// iterated. LastModified is raised past the current version's if necessary,
+// so that caches of it are always invalidated. Before anything is copied,
+// the update is refused if its estimate would exceed the limit, or the
+// clade index and cube are dropped if that brings it within the limit.
+func (d *Dataset) Upsert(rows []Row, separator string, lastModified int64) (UpsertResult, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	v := d.Current()
+	if lastModified <= v.LastModified {
+		lastModified = v.LastModified + 1
+	}
+	if len(rows) == 0 {
+		return UpsertResult{Records: v.Planner.Store.Len() - v.Planner.Store.deletedCount(), LastModified: v.LastModified}, nil
+	}
+
+	var dropped []string
+	if d.Limit > 0 {
+		data, indexes := v.Planner.upsertEstimate(rows)
+		n := v.Planner.Footprint().Total + data + indexes["mutations"]
+		if n > d.Limit {
+			return UpsertResult{}, fmt.Errorf("%w: the update needs an estimated %v bytes of the %v allowed", ErrMemoryLimit, n, d.Limit)
+		}
+		if n+indexes["clades"]+indexes["cube"] > d.Limit {
+			for _, name := range []string{"clades", "cube"} {
+				if _, ok := indexes[name]; ok {
+					dropped = append(dropped, name)
+				}
+			}
+		}
+	}
+
+	db := v.Planner.Store.db.clone()
+	for i := range rows {
+		if err := db.validateRow(&rows[i], separator); err != nil {
+			return UpsertResult{}, fmt.Errorf("row %v: %w", i+1, err)
+		}
+	}
+	delta := CreateColumnStore(db)
+	dates := make([]string, len(rows))
+	for i := range rows {
+		delta.Append(db.indexRow(&rows[i], separator))
+		dates[i] = rows[i].Date
+	}
+	s := v.Planner.Store.clone(db)
+	existing := s.existing(dates)
+
+	result := UpsertResult{LastModified: lastModified, Dropped: dropped}
+	// existing records whose count was set by the delta
+	replaced := make(map[int]bool)
+	// the first row of each new key
+	inserted := make(map[string]int)
+	for j := range rows {
+		key := delta.key(j)
+		if i, ok := existing[key]; ok {
+			if rows[j].Deleted {
+				if s.isDeleted(i) {
+					result.Missing++
+				} else {
+					s.setDeleted(i, true)
+					result.Deleted++
+				}
+				delete(replaced, i)
+			} else if replaced[i] {
+				s.Counts[i] += delta.Counts[j]
+			} else {
+				if s.isDeleted(i) {
+					s.setDeleted(i, false)
+					result.Inserted++
+				} else {
+					result.Updated++
+				}
+				s.Counts[i] = delta.Counts[j]
+				replaced[i] = true
+			}
+		} else if first, ok := inserted[key]; ok {
+			if rows[j].Deleted {
+				delete(inserted, key)
+			} else {
+				delta.Counts[first] += delta.Counts[j]
+			}
+		} else if rows[j].Deleted {
+			result.Missing++
+		} else {
+			inserted[key] = j
+		}
+	}
+	order := make([]int, 0, len(inserted))
+	for _, j := range inserted {
+		order = append(order, j)
+	}
+	result.Inserted += len(order)
+
+	from := s.Len()
+	sort.Slice(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if delta.Dates[i] != delta.Dates[j] {
+			return delta.value(delta.Dates[i]) < delta.value(delta.Dates[j])
+		}
+		if delta.Areas[i] != delta.Areas[j] {
+			return delta.value(delta.Areas[i]) < delta.value(delta.Areas[j])
+		}
+		return i < j
+	})
+	dec := delta.decoder()
+	for _, j := range order {
+		s.Append(dec.decode(j))
+	}
+	if s.Partitions != nil {
+		s.partitionFrom(from)
+	}
+
+	p := *v.Planner
+	p.Store = s
+	if p.Mutations != nil && s.Len() > from {
+		p.Mutations = p.Mutations.extend(s, from)
+	}
+	if dropped != nil {
+		p.Clades, p.Cube = nil, nil
+	}
+	if p.Clades != nil && s.Len() > from {
+		p.Clades = CreateCladeIndex(s)
+	}
+	if p.Cube != nil {
+		p.Cube = s.Cube()
+	}
+	if d.Limit > 0 {
+		if f := p.Footprint(); f.Total > d.Limit {
+			return UpsertResult{}, fmt.Errorf("%w: the update needs %v bytes of the %v allowed", ErrMemoryLimit, f.Total, d.Limit)
+		}
+	}
+	result.Records = s.Len() - s.deletedCount()
+	d.current.Store(&Version{LastModified: lastModified, Planner: &p})
+	return result, nil
+}
@@ -0,0 +1,198 @@
+package covince
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testDataset(n int) *Dataset {
+	s := testColumnStore(testDatabase(n))
+	s.Partition()
+	return CreateDataset(&Planner{
+		Store:     s,
+		Mutations: CreateMutationIndex(s),
+		Clades:    CreateCladeIndex(s),
+		Cube:      s.Cube(),
+		Threads:   2,
+	}, 1000)
+}
+
+// totalCount sums the counts of the records that could match the query's
+// first lineage, or all records without one.
+func totalCount(t *testing.T, scan ContextIteratorFunc, q *Query) int {
+	p, err := MapReduce(context.Background(), scan, 2, func() Partial {
+		return NewCountsPartial(func(m map[string]int, r *Record) {
+			inDates := q.DateFrom <= r.Date.Value && (q.DateTo == "" || r.Date.Value <= q.DateTo)
+			if len(q.Lineages) == 0 || inDates && matches(r, &q.Lineages[0]) {
+				m["total"] += r.Count
+			}
+		})
+	})
+	assert.Nil(t, err)
+	return p.(*CountsPartial).Counts["total"]
+}
+
+func matches(r *Record, ql *QueryLineage) bool {
+	if !strings.HasPrefix(r.PangoClade.Value, ql.PangoClade) {
+		return false
+	}
+	for _, m := range ql.Mutations {
+		found := false
+		for _, rm := range r.Mutations {
+			found = found || rm.Prefix == m.Prefix && rm.Suffix == m.Suffix
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUpsert(t *testing.T) {
+	d := testDataset(2000)
+	before := d.Current()
+	s := before.Planner.Store
+
+	var existing Row
+	s.Iterate(context.Background(), 0, 1, func(r *Record) {
+		existing = Row{Area: r.Area.Value, Date: r.Date.Value, PangoClade: r.PangoClade.Value, Metadata: []string{r.Metadata[0].Value}, Count: 100}
+		for i := len(r.Mutations) - 1; i >= 0; i-- {
+			existing.Mutations = append(existing.Mutations, r.Mutations[i].Key)
+		}
+	})
+	previous := int(s.Counts[0])
+	added := Row{Area: "E1", Date: "2021-02-01", PangoClade: "C.", Metadata: []string{"hospital"}, Mutations: []string{"S:Z1", "N:A"}, Count: 3}
+
+	result, err := d.Upsert([]Row{existing, added, added}, ":", 500)
+	assert.Nil(t, err)
+	assert.Equal(t, UpsertResult{Inserted: 1, Updated: 1, Records: 2001, LastModified: 1001}, result)
+
+	after := d.Current()
+	assert.Equal(t, int64(1001), after.LastModified)
+	assert.Equal(t, 2000, before.Planner.Store.Len())
+	assert.Equal(t, previous, int(before.Planner.Store.Counts[0]))
+	assert.Equal(t, 100, int(after.Planner.Store.Counts[0]))
+
+	p := after.Planner
+	total := totalCount(t, before.Planner.Store.Scan(2), &Query{})
+	assert.Equal(t, total-previous+100+6, totalCount(t, p.Store.Scan(2), &Query{}))
+	assert.Equal(t, totalCount(t, p.Store.Scan(2), &Query{}), totalCount(t, p.Cube.Scan(2), &Query{}))
+
+	for _, q := range []Query{
+		{Lineages: []QueryLineage{{Key: "C", PangoClade: "C."}}},
+		{Lineages: []QueryLineage{{Key: "B+S:Z1", PangoClade: "", Mutations: []Mutation{{Prefix: "S", Suffix: "Z1"}}}}},
+		{Lineages: []QueryLineage{{Key: "C", PangoClade: "C."}}, DateFrom: "2021-02-01"},
+	} {
+		q := q
+		plan := p.Plan(&q, false)
+		assert.NotEqual(t, PLAN_SCAN, plan.Strategy)
+		assert.Equal(t, 6, totalCount(t, plan.Scan, &q))
+	}
+	assert.Equal(t, 1, len(p.Mutations.Postings[p.Mutations.lookup[mutationLookupKey("S", "Z1")]]))
+	assert.True(t, p.Store.Database().Genes["S"])
+
+	t.Run("upserting the same rows again only updates", func(t *testing.T) {
+		result, err := d.Upsert([]Row{added}, ":", 2000)
+		assert.Nil(t, err)
+		assert.Equal(t, UpsertResult{Updated: 1, Records: 2001, LastModified: 2000}, result)
+		assert.Equal(t, 3, totalCount(t, d.Current().Planner.Store.Scan(2), &Query{Lineages: []QueryLineage{{PangoClade: "C."}}}))
+	})
+
+	t.Run("invalid rows leave the version unchanged", func(t *testing.T) {
+		current := d.Current()
+		_, err := d.Upsert([]Row{added, {Metadata: []string{"hospital"}, Mutations: []string{"S"}}}, ":", 3000)
+		assert.EqualError(t, err, `row 2: mutation "S" has no separator ":"`)
+		_, err = d.Upsert([]Row{{}}, ":", 3000)
+		assert.EqualError(t, err, "row 1: expected 1 metadata values, got 0")
+		assert.Same(t, current, d.Current())
+	})
+}
+
+func rowOf(s *ColumnStore, i int) Row {
+	var row Row
+	s.Iterate(context.Background(), i, i+1, func(r *Record) {
+		row = Row{Area: r.Area.Value, Date: r.Date.Value, PangoClade: r.PangoClade.Value, Count: r.Count}
+		for _, v := range r.Metadata {
+			row.Metadata = append(row.Metadata, v.Value)
+		}
+		for _, m := range r.Mutations {
+			row.Mutations = append(row.Mutations, m.Key)
+		}
+	})
+	return row
+}
+
+func TestUpsertTombstones(t *testing.T) {
+	d := testDataset(2000)
+	before := d.Current()
+	s := before.Planner.Store
+	total := totalCount(t, s.Scan(2), &Query{})
+
+	deleted := rowOf(s, 0)
+	deleted.Deleted = true
+	deleted.Count = 0
+	// mutations in another order identify the same record
+	for i, j := 0, len(deleted.Mutations)-1; i < j; i, j = i+1, j-1 {
+		deleted.Mutations[i], deleted.Mutations[j] = deleted.Mutations[j], deleted.Mutations[i]
+	}
+	replaced := rowOf(s, 1)
+	removed := replaced
+	removed.Deleted = true
+	replaced.Count = 50
+	added := Row{Area: "E1", Date: "2021-02-01", PangoClade: "C.", Metadata: []string{"hospital"}, Count: 3}
+	cancelled := added
+	cancelled.Deleted = true
+
+	result, err := d.Upsert([]Row{deleted, deleted, removed, replaced, added, cancelled}, ":", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, UpsertResult{Inserted: 1, Deleted: 2, Missing: 1, Records: 1999, LastModified: 1001}, result)
+
+	p := d.Current().Planner
+	expected := total - int(s.Counts[0]) - int(s.Counts[1]) + 50
+	assert.Equal(t, expected, totalCount(t, p.Store.Scan(2), &Query{}))
+	assert.Equal(t, expected, totalCount(t, p.Cube.Scan(2), &Query{}))
+	assert.Equal(t, total, totalCount(t, s.Scan(2), &Query{}))
+	assert.Equal(t, 0, totalCount(t, p.Store.Scan(2), &Query{Lineages: []QueryLineage{{PangoClade: "C."}}}))
+
+	q := Query{Lineages: []QueryLineage{{Key: "A", PangoClade: deleted.PangoClade}}, DateFrom: deleted.Date, DateTo: deleted.Date}
+	plan := p.Plan(&q, false)
+	assert.NotEqual(t, PLAN_SCAN, plan.Strategy)
+	assert.Equal(t, totalCount(t, p.Store.Scan(2), &q), totalCount(t, plan.Scan, &q))
+	assert.Less(t, plan.RowsScanned, int64(plan.EstimatedRows))
+
+	t.Run("upserting a deleted record restores it", func(t *testing.T) {
+		deleted.Deleted = false
+		deleted.Count = 7
+		result, err := d.Upsert([]Row{deleted}, ":", 0)
+		assert.Nil(t, err)
+		assert.Equal(t, UpsertResult{Inserted: 1, Records: 2000, LastModified: 1002}, result)
+		assert.Equal(t, expected+7, totalCount(t, d.Current().Planner.Store.Scan(2), &Query{}))
+	})
+}
+
+func TestUpsertConcurrentScans(t *testing.T) {
+	d := testDataset(2000)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				v := d.Current()
+				q := &Query{Lineages: []QueryLineage{{Key: "A", PangoClade: "A."}}}
+				plan := v.Planner.Plan(q, false)
+				expected := totalCount(t, v.Planner.Store.Scan(2), q)
+				assert.Equal(t, expected, totalCount(t, plan.Scan, q))
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		_, err := d.Upsert([]Row{{Area: "E1", Date: "2021-01-05", PangoClade: "A.", Metadata: []string{"community"}, Mutations: []string{"S:1"}, Count: i + 1}}, ":", 0)
+		assert.Nil(t, err)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,32 @@
+package covince
+
+// Deduplicate sorts the records by date and area and merges those with the
+// same key into the first of them, summing their counts. It returns the
+// number of records merged away. Deleted records are left as they are. Any
+// index of record ids must be created afterwards.
+func (s *ColumnStore) Deduplicate() int {
+	s.sortByDateAndArea()
+	order := make([]int, 0, s.Len())
+	var run map[string]int
+	for i := 0; i < s.Len(); i++ {
+		if i == 0 || s.Dates[i] != s.Dates[i-1] || s.Areas[i] != s.Areas[i-1] {
+			run = make(map[string]int)
+		}
+		if s.isDeleted(i) {
+			order = append(order, i)
+			continue
+		}
+		key := s.key(i)
+		if first, ok := run[key]; ok {
+			s.Counts[first] += s.Counts[i]
+			continue
+		}
+		run[key] = i
+		order = append(order, i)
+	}
+	merged := s.Len() - len(order)
+	if merged > 0 {
+		s.permute(order)
+	}
+	return merged
+}
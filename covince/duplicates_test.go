@@ -0,0 +1,44 @@
+package covince
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicate(t *testing.T) {
+	db := testDatabase(1000)
+	s := testColumnStore(db)
+	unique := testColumnStore(db)
+	// the same records again, with their mutations in reverse order
+	for i := range db.Records {
+		r := db.Records[i]
+		muts := make([]*Mutation, len(r.Mutations))
+		for j, m := range r.Mutations {
+			muts[len(muts)-1-j] = m
+		}
+		r.Mutations = muts
+		s.Append(&r)
+	}
+	s.setDeleted(5, true)
+
+	assert.Equal(t, 999, s.Deduplicate())
+	assert.Equal(t, 1001, s.Len())
+	assert.Equal(t, 0, s.Deduplicate())
+
+	newPartial := func() Partial {
+		return NewCountsPartial(func(m map[string]int, r *Record) {
+			m[r.Date.Value+r.Area.Value+r.PangoClade.Value] += r.Count
+		})
+	}
+	expected, _ := MapReduce(context.Background(), unique.Scan(1), 1, newPartial)
+	actual, _ := MapReduce(context.Background(), s.Scan(1), 1, newPartial)
+	for k, n := range expected.(*CountsPartial).Counts {
+		expected.(*CountsPartial).Counts[k] = 2 * n
+	}
+	// only the deleted record's duplicate remains
+	deleted := db.Records[5]
+	expected.(*CountsPartial).Counts[deleted.Date.Value+deleted.Area.Value+deleted.PangoClade.Value] -= deleted.Count
+	assert.Equal(t, expected.(*CountsPartial).Counts, actual.(*CountsPartial).Counts)
+}
@@ -0,0 +1,170 @@
+package covince
+
+import (
+	"context"
+	"math"
+	"sort"
+)
+
+const DEFAULT_Z_THRESHOLD = 1.96
+
+type DateRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type EmergingOpts struct {
+	Baseline DateRange
+	Lineage  string
+	MinCount int
+	// mutation counts below this are reported as null
+	SuppressionMin int
+	ZThreshold     float64
+}
+
+type EmergingSignal struct {
+	Key           string   `json:"key"`
+	Type          string   `json:"type"`
+	BaselineCount *int     `json:"baseline_count"`
+	RecentCount   int      `json:"recent_count"`
+	BaselineShare *float64 `json:"baseline_share"`
+	RecentShare   float64  `json:"recent_share"`
+	Z             float64  `json:"z"`
+}
+
+type EmergingResult struct {
+	Baseline  DateRange         `json:"baseline"`
+	Recent    DateRange         `json:"recent"`
+	Lineages  []*EmergingSignal `json:"lineages"`
+	Mutations []*EmergingSignal `json:"mutations"`
+}
+
+type SortByZ []*EmergingSignal
+
+func (s SortByZ) Less(i, j int) bool {
+	if s[i].Z == s[j].Z {
+		return s[i].Key < s[j].Key
+	}
+	return s[i].Z > s[j].Z
+}
+func (s SortByZ) Len() int      { return len(s) }
+func (s SortByZ) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+
+// two-proportion z-test using the pooled proportion
+func zScore(x1, n1, x2, n2 int) float64 {
+	if n1 == 0 || n2 == 0 {
+		return 0
+	}
+	p := float64(x1+x2) / float64(n1+n2)
+	se := math.Sqrt(p * (1 - p) * (1/float64(n1) + 1/float64(n2)))
+	if se == 0 {
+		return 0
+	}
+	return (float64(x2)/float64(n2) - float64(x1)/float64(n1)) / se
+}
+
+func compareWindows(t string, baseline, recent map[string]int, baselineTotal, recentTotal int, suppressionMin int, opts *EmergingOpts) []*EmergingSignal {
+	flagged := []*EmergingSignal{}
+	for k, x2 := range recent {
+		if x2 < opts.MinCount {
+			continue
+		}
+		x1 := baseline[k]
+		z := zScore(x1, baselineTotal, x2, recentTotal)
+		if z < opts.ZThreshold {
+			continue
+		}
+		signal := &EmergingSignal{
+			Key:         k,
+			Type:        t,
+			RecentCount: x2,
+			RecentShare: float64(x2) / float64(recentTotal),
+			Z:           z,
+		}
+		// the recent count is at least the minimum, but the baseline may not be
+		if x1 >= suppressionMin {
+			share := float64(x1) / float64(baselineTotal)
+			signal.BaselineCount, signal.BaselineShare = &x1, &share
+		}
+		flagged = append(flagged, signal)
+	}
+	sort.Sort(SortByZ(flagged))
+	return flagged
+}
+
+func mutationCounts(m map[string]*MutationSearch) map[string]int {
+	counts := make(map[string]int, len(m))
+	for k, v := range m {
+		counts[k] = v.Count
+	}
+	return counts
+}
+
+func sum(m map[string]int) int {
+	total := 0
+	for _, v := range m {
+		total += v
+	}
+	return total
+}
+
+func EmergingSearch(foreach IteratorFunc, q *Query, opts *EmergingOpts) EmergingResult {
+	result, _ := EmergingSearchContext(context.Background(), WithContext(foreach), 1, q, opts)
+	return result
+}
+
+// EmergingSearchContext compares both windows in a single pass, split
+// across threads. Defaults are applied to a copy of the caller's options.
+func EmergingSearchContext(ctx context.Context, scan ContextIteratorFunc, threads int, q *Query, options *EmergingOpts) (EmergingResult, error) {
+	opts := *options
+	recentQ := *q
+	if len(recentQ.Lineages) == 0 {
+		// match every record when no parent lineage is given
+		recentQ.Lineages = []QueryLineage{{Key: opts.Lineage}}
+	} else if opts.Lineage == "" && len(recentQ.Lineages) == 1 {
+		opts.Lineage = recentQ.Lineages[0].Key
+	}
+	baselineQ := recentQ
+	baselineQ.DateFrom = opts.Baseline.From
+	baselineQ.DateTo = opts.Baseline.To
+
+	so := SearchOpts{Lineage: opts.Lineage}
+
+	p, err := MapReduce(ctx, scan, threads, func() Partial {
+		return Partials{
+			NewCountsPartial(func(m map[string]int, r *Record) { Lineages(m, &baselineQ, r) }),
+			NewCountsPartial(func(m map[string]int, r *Record) { Lineages(m, &recentQ, r) }),
+			NewMutationsPartial(&so, &baselineQ),
+			NewMutationsPartial(&so, &recentQ),
+		}
+	})
+	if err != nil {
+		return EmergingResult{}, err
+	}
+	partials := p.(Partials)
+	baselineLineages := partials[0].(*CountsPartial).Counts
+	recentLineages := partials[1].(*CountsPartial).Counts
+	baselineMuts := partials[2].(*MutationsPartial)
+	recentMuts := partials[3].(*MutationsPartial)
+
+	if opts.ZThreshold == 0 {
+		opts.ZThreshold = DEFAULT_Z_THRESHOLD
+	}
+
+	return EmergingResult{
+		Baseline: opts.Baseline,
+		Recent:   DateRange{From: q.DateFrom, To: q.DateTo},
+		Lineages: compareWindows(
+			"lineage",
+			baselineLineages, recentLineages,
+			sum(baselineLineages), sum(recentLineages),
+			0, &opts,
+		),
+		Mutations: compareWindows(
+			"mutation",
+			mutationCounts(baselineMuts.Mutations), mutationCounts(recentMuts.Mutations),
+			baselineMuts.Total.Count, recentMuts.Total.Count,
+			opts.SuppressionMin, &opts,
+		),
+	}, nil
+}
@@ -0,0 +1,90 @@
+package covince
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestZScore(t *testing.T) {
+	assert.Equal(t, 0.0, zScore(0, 0, 1, 1))
+	assert.Equal(t, 0.0, zScore(5, 10, 5, 10))
+	assert.InDelta(t, 3.086, zScore(20, 100, 40, 100), 0.001)
+	assert.Less(t, zScore(40, 100, 20, 100), 0.0)
+}
+
+func TestEmergingSearch(t *testing.T) {
+	records := []Record{
+		{PangoClade: value("B."), Date: value("2020-09-01"), Area: value("A"), Count: 90, Mutations: []*Mutation{&testMutations[0]}},
+		{PangoClade: value("B.1."), Date: value("2020-09-01"), Area: value("A"), Count: 10, Mutations: []*Mutation{&testMutations[1]}},
+		{PangoClade: value("B."), Date: value("2020-10-01"), Area: value("A"), Count: 50, Mutations: []*Mutation{&testMutations[0]}},
+		{PangoClade: value("B.1."), Date: value("2020-10-01"), Area: value("A"), Count: 50, Mutations: []*Mutation{&testMutations[1]}},
+		{PangoClade: value("B.1."), Date: value("2020-10-01"), Area: value("B"), Count: 1000, Mutations: []*Mutation{&testMutations[1]}},
+	}
+	foreach := func(agg func(r *Record), sliceNum int) {
+		for _, r := range records {
+			agg(&r)
+		}
+	}
+
+	t.Run("flags increase in share", func(t *testing.T) {
+		q := Query{Area: "A", DateFrom: "2020-10-01", DateTo: "2020-10-01"}
+		opts := EmergingOpts{
+			Baseline: DateRange{From: "2020-09-01", To: "2020-09-01"},
+			MinCount: 10,
+		}
+		result := EmergingSearch(foreach, &q, &opts)
+		assert.Equal(t, 0.0, opts.ZThreshold)
+		assert.Len(t, result.Lineages, 1)
+		assert.Equal(t, "B.1.", result.Lineages[0].Key)
+		assert.Equal(t, 10, *result.Lineages[0].BaselineCount)
+		assert.Equal(t, 50, result.Lineages[0].RecentCount)
+		assert.Equal(t, 0.5, result.Lineages[0].RecentShare)
+		assert.Len(t, result.Mutations, 1)
+		assert.Equal(t, "B:B", result.Mutations[0].Key)
+		assert.Equal(t, 10, *result.Mutations[0].BaselineCount)
+	})
+
+	t.Run("suppresses small baseline mutation counts", func(t *testing.T) {
+		q := Query{Area: "A", DateFrom: "2020-10-01", DateTo: "2020-10-01"}
+		opts := EmergingOpts{
+			Baseline:       DateRange{From: "2020-09-01", To: "2020-09-01"},
+			MinCount:       11,
+			SuppressionMin: 11,
+		}
+		result := EmergingSearch(foreach, &q, &opts)
+		assert.Len(t, result.Mutations, 1)
+		assert.Equal(t, 50, result.Mutations[0].RecentCount)
+		assert.Nil(t, result.Mutations[0].BaselineCount)
+		assert.Nil(t, result.Mutations[0].BaselineShare)
+		// lineage counts are not suppressed elsewhere
+		assert.Equal(t, 10, *result.Lineages[0].BaselineCount)
+	})
+
+	t.Run("respects min count", func(t *testing.T) {
+		q := Query{Area: "A", DateFrom: "2020-10-01", DateTo: "2020-10-01"}
+		opts := EmergingOpts{
+			Baseline: DateRange{From: "2020-09-01", To: "2020-09-01"},
+			MinCount: 51,
+		}
+		result := EmergingSearch(foreach, &q, &opts)
+		assert.Empty(t, result.Lineages)
+		assert.Empty(t, result.Mutations)
+	})
+
+	t.Run("within parent lineage", func(t *testing.T) {
+		q := Query{
+			Lineages: []QueryLineage{{Key: "B.1", PangoClade: "B.1."}},
+			Area:     "A",
+			DateFrom: "2020-10-01",
+			DateTo:   "2020-10-01",
+		}
+		opts := EmergingOpts{
+			Baseline: DateRange{From: "2020-09-01", To: "2020-09-01"},
+		}
+		result := EmergingSearch(foreach, &q, &opts)
+		// every B.1 record carries B:B, so its share cannot increase
+		assert.Empty(t, result.Mutations)
+		assert.Equal(t, "", opts.Lineage)
+	})
+}
@@ -0,0 +1,111 @@
+package covince
+
+// MutationIndex is an inverted index from each mutation to the sorted ids of
+// the records that have it.
+type MutationIndex struct {
+	Postings [][]uint32
+	lookup   map[string]uint32
+}
+
+func mutationLookupKey(prefix string, suffix string) string {
+	return prefix + "\x00" + suffix
+}
+
+func CreateMutationIndex(s *ColumnStore) *MutationIndex {
+	idx := &MutationIndex{
+		Postings: make([][]uint32, len(s.db.Mutations)),
+		lookup:   make(map[string]uint32, len(s.db.Mutations)),
+	}
+	for i, m := range s.db.Mutations {
+		idx.lookup[mutationLookupKey(m.Prefix, m.Suffix)] = uint32(i)
+	}
+	counts := make([]int, len(s.db.Mutations))
+	for _, id := range s.MutationIds {
+		counts[id]++
+	}
+	for id, n := range counts {
+		idx.Postings[id] = make([]uint32, 0, n)
+	}
+	for i := 0; i < s.Len(); i++ {
+		for _, id := range s.MutationIds[s.MutationOffsets[i]:s.MutationOffsets[i+1]] {
+			idx.Postings[id] = append(idx.Postings[id], uint32(i))
+		}
+	}
+	return idx
+}
+
+func intersect(a []uint32, b []uint32) []uint32 {
+	result := make([]uint32, 0, len(a))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			i++
+		} else if a[i] > b[j] {
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func union(a []uint32, b []uint32) []uint32 {
+	result := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if a[i] < b[j] {
+			result = append(result, a[i])
+			i++
+		} else if a[i] > b[j] {
+			result = append(result, b[j])
+			j++
+		} else {
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// withMutations returns the ids of the records that have every mutation of
+// the lineage.
+func (idx *MutationIndex) withMutations(ql *QueryLineage) []uint32 {
+	postings := make([][]uint32, len(ql.Mutations))
+	shortest := 0
+	for i, qm := range ql.Mutations {
+		if id, ok := idx.lookup[mutationLookupKey(qm.Prefix, qm.Suffix)]; ok {
+			postings[i] = idx.Postings[id]
+		}
+		if len(postings[i]) < len(postings[shortest]) {
+			shortest = i
+		}
+	}
+	ids := postings[shortest]
+	for i, p := range postings {
+		if i != shortest {
+			ids = intersect(ids, p)
+		}
+	}
+	return ids
+}
+
+// Candidates returns the ids of the records that have every mutation of at
+// least one of the lineages. It returns false when a lineage has no
+// mutations, as any record could then match.
+func (idx *MutationIndex) Candidates(lineages []QueryLineage) ([]uint32, bool) {
+	if len(lineages) == 0 {
+		return nil, false
+	}
+	var candidates []uint32
+	for i := range lineages {
+		if len(lineages[i].Mutations) == 0 {
+			return nil, false
+		}
+		candidates = union(candidates, idx.withMutations(&lineages[i]))
+	}
+	return candidates, true
+}
@@ -0,0 +1,88 @@
+package covince
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntersectUnion(t *testing.T) {
+	assert.Equal(t, []uint32{2, 5}, intersect([]uint32{1, 2, 5, 7}, []uint32{2, 3, 5}))
+	assert.Equal(t, []uint32{}, intersect([]uint32{1}, nil))
+	assert.Equal(t, []uint32{1, 2, 3, 5, 7}, union([]uint32{1, 2, 5, 7}, []uint32{2, 3, 5}))
+}
+
+func TestMutationIndex(t *testing.T) {
+	db := testDatabase(300)
+	s := testColumnStore(db)
+	idx := CreateMutationIndex(s)
+
+	t.Run("requires mutations on every lineage", func(t *testing.T) {
+		_, ok := idx.Candidates([]QueryLineage{
+			{Key: "B+S:1", PangoClade: "B.", Mutations: []Mutation{{Prefix: "S", Suffix: "1"}}},
+			{Key: "B", PangoClade: "B."},
+		})
+		assert.False(t, ok)
+	})
+
+	t.Run("unknown mutations have no candidates", func(t *testing.T) {
+		ids, ok := idx.Candidates([]QueryLineage{
+			{Key: "B+S:X", PangoClade: "B.", Mutations: []Mutation{{Prefix: "S", Suffix: "X"}}},
+		})
+		assert.True(t, ok)
+		assert.Len(t, ids, 0)
+	})
+
+	t.Run("matches a full scan", func(t *testing.T) {
+		q := Query{
+			Lineages: []QueryLineage{
+				{Key: "B+S:1+N:A", PangoClade: "B.", Mutations: []Mutation{{Prefix: "S", Suffix: "1"}, {Prefix: "N", Suffix: "A"}}},
+				{Key: "A+S:4", PangoClade: "A.", Mutations: []Mutation{{Prefix: "S", Suffix: "4"}}},
+			},
+		}
+		ids, ok := idx.Candidates(q.Lineages)
+		assert.True(t, ok)
+		for _, id := range ids {
+			assert.True(t, len(db.Records[id].Mutations) > 0)
+		}
+
+		newPartial := func() Partial {
+			return NewIndexPartial(func(i Index, r *Record) { Frequency(i, &q, r) })
+		}
+		expected, _ := MapReduce(context.Background(), s.Scan(1), 1, newPartial)
+		scan, ok := s.Select(idx, nil, &q, 3)
+		assert.True(t, ok)
+		actual, err := MapReduce(context.Background(), scan, 3, newPartial)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, expected.(*IndexPartial).Index)
+		assert.Equal(t, expected.(*IndexPartial).Index, actual.(*IndexPartial).Index)
+	})
+}
+
+var benchmarkMutationQuery = Query{
+	Lineages: []QueryLineage{
+		{Key: "B+S:1+N:A", PangoClade: "B.", Mutations: []Mutation{{Prefix: "S", Suffix: "1"}, {Prefix: "N", Suffix: "A"}}},
+	},
+}
+
+func BenchmarkMutationFullScan(b *testing.B) {
+	s := testColumnStore(testDatabase(BENCHMARK_RECORDS))
+	scan := s.Scan(1)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := make(Index)
+		scan(context.Background(), func(r *Record) { Frequency(i, &benchmarkMutationQuery, r) }, -1)
+	}
+}
+
+func BenchmarkMutationIndexScan(b *testing.B) {
+	s := testColumnStore(testDatabase(BENCHMARK_RECORDS))
+	idx := CreateMutationIndex(s)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		i := make(Index)
+		scan, _ := s.Select(idx, nil, &benchmarkMutationQuery, 1)
+		scan(context.Background(), func(r *Record) { Frequency(i, &benchmarkMutationQuery, r) }, -1)
+	}
+}
@@ -0,0 +1,58 @@
+package covince
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// how many records are visited between checks for cancellation
+const CANCEL_CHECK_INTERVAL = 1024
+
+// ContextIteratorFunc is an IteratorFunc that stops early once ctx is done,
+// returning ctx.Err().
+type ContextIteratorFunc func(ctx context.Context, aggregationFunc func(r *Record), sliceIndex int) error
+
+// Bind fixes the context of the iterator, for aggregations that take an
+// IteratorFunc. Callers should check ctx.Err() afterwards, as the results
+// will be partial if the scan was cancelled.
+func (f ContextIteratorFunc) Bind(ctx context.Context) IteratorFunc {
+	return func(aggregationFunc func(r *Record), sliceIndex int) {
+		f(ctx, aggregationFunc, sliceIndex)
+	}
+}
+
+// WithContext adapts an IteratorFunc that cannot stop early. Once ctx is done
+// the remaining records are skipped rather than aggregated.
+func WithContext(foreach IteratorFunc) ContextIteratorFunc {
+	return func(ctx context.Context, aggregationFunc func(r *Record), sliceIndex int) error {
+		var cancelled int32
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				atomic.StoreInt32(&cancelled, 1)
+			case <-done:
+			}
+		}()
+		foreach(func(r *Record) {
+			if atomic.LoadInt32(&cancelled) == 0 {
+				aggregationFunc(r)
+			}
+		}, sliceIndex)
+		return ctx.Err()
+	}
+}
+
+// IterateRecords visits each record, checking for cancellation periodically.
+func IterateRecords(ctx context.Context, records []Record, aggregationFunc func(r *Record)) error {
+	for i := range records {
+		if i%CANCEL_CHECK_INTERVAL == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		aggregationFunc(&records[i])
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,66 @@
+package covince
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIterateRecords(t *testing.T) {
+	records := make([]Record, CANCEL_CHECK_INTERVAL*3)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	visited := 0
+	err := IterateRecords(ctx, records, func(r *Record) {
+		visited++
+		if visited == CANCEL_CHECK_INTERVAL {
+			cancel()
+		}
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, CANCEL_CHECK_INTERVAL, visited)
+
+	visited = 0
+	err = IterateRecords(context.Background(), records, func(r *Record) { visited++ })
+	assert.Nil(t, err)
+	assert.Equal(t, len(records), visited)
+}
+
+func TestWithContext(t *testing.T) {
+	foreach := func(agg func(r *Record), sliceNum int) {
+		for _, r := range testRecords {
+			agg(&r)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	visited := 0
+	err := WithContext(foreach)(ctx, func(r *Record) { visited++ }, -1)
+	assert.Equal(t, context.Canceled, err)
+	// skipping starts once the cancellation has been observed
+	assert.LessOrEqual(t, visited, len(testRecords))
+
+	visited = 0
+	err = WithContext(foreach)(context.Background(), func(r *Record) { visited++ }, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(testRecords), visited)
+}
+
+func TestSearchMutationsContext(t *testing.T) {
+	so := SearchOpts{Lineage: "B", Limit: 20, Threads: len(testRecords)}
+	q := Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}
+	scan := func(ctx context.Context, agg func(r *Record), i int) error {
+		return IterateRecords(ctx, testRecords, agg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := SearchMutationsContext(ctx, scan, &q, &so)
+	assert.Equal(t, context.Canceled, err)
+
+	so.Threads = 0
+	_, err = SearchMutationsContext(context.Background(), scan, &q, &so)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,224 @@
+package covince
+
+import (
+	"errors"
+	"unsafe"
+)
+
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+// Footprint is an estimate of the bytes held by the data, where indexes are
+// keyed by name and omitted if they were not built.
+type Footprint struct {
+	Values    int            `json:"values"`
+	Mutations int            `json:"mutations"`
+	Records   int            `json:"records"`
+	Indexes   map[string]int `json:"indexes"`
+	Total     int            `json:"total"`
+}
+
+var (
+	intSize       = int(unsafe.Sizeof(int(0)))
+	idSize        = int(unsafe.Sizeof(uint32(0)))
+	stringSize    = int(unsafe.Sizeof(""))
+	sliceSize     = int(unsafe.Sizeof([]uint32{}))
+	pointerSize   = int(unsafe.Sizeof(&Value{}))
+	partitionSize = int(unsafe.Sizeof(Partition{}))
+)
+
+// mapSize estimates a map from its buckets, which hold 8 entries with a byte
+// of hash each and an overflow pointer, and are on average 6.5 entries full.
+func mapSize(entries int, entrySize int) int {
+	return entries * (8*(entrySize+1) + pointerSize) * 2 / 13
+}
+
+func (db *Database) valuesSize() int {
+	n := len(db.Values)*int(unsafe.Sizeof(Value{})) + mapSize(len(db.ValueLookup), stringSize+intSize)
+	// the lookup shares the values' strings
+	for _, v := range db.Values {
+		n += len(v.Value)
+	}
+	return n
+}
+
+func (db *Database) mutationsSize() int {
+	n := len(db.Mutations)*int(unsafe.Sizeof(Mutation{})) +
+		mapSize(len(db.MutationLookup), stringSize+intSize) +
+		mapSize(len(db.Genes), stringSize+1)
+	// the prefix and suffix are parts of the key
+	for _, m := range db.Mutations {
+		n += len(m.Key)
+	}
+	return n
+}
+
+func (db *Database) recordsSize() int {
+	n := len(db.Records) * int(unsafe.Sizeof(Record{}))
+	for _, r := range db.Records {
+		n += (len(r.Metadata) + len(r.Mutations)) * pointerSize
+	}
+	return n
+}
+
+func (s *ColumnStore) partitionsSize() int {
+	return len(s.Partitions) * partitionSize
+}
+
+func (idx *MutationIndex) size() int {
+	n := len(idx.Postings)*sliceSize + mapSize(len(idx.lookup), stringSize+idSize)
+	for _, p := range idx.Postings {
+		n += len(p) * idSize
+	}
+	for k := range idx.lookup {
+		n += len(k)
+	}
+	return n
+}
+
+func (c *CladeIndex) size() int {
+	n := len(c.Clades)*stringSize + len(c.Records)*sliceSize + len(c.ranks)*idSize
+	for _, records := range c.Records {
+		n += len(records) * idSize
+	}
+	return n
+}
+
+// estimates of indexes before they are built, the cube's being its largest
+// possible size
+func mutationIndexEstimate(s *ColumnStore) int {
+	n := len(s.MutationIds)*idSize + len(s.db.Mutations)*sliceSize + mapSize(len(s.db.Mutations), stringSize+idSize)
+	for _, m := range s.db.Mutations {
+		n += len(m.Key)
+	}
+	return n
+}
+
+func cladeIndexSize(records int, values int) int {
+	return records*idSize + values*(idSize+stringSize+sliceSize)
+}
+
+func cladeIndexEstimate(s *ColumnStore) int {
+	return cladeIndexSize(s.Len(), len(s.db.Values))
+}
+
+func cubeSize(records int, partitions int) int {
+	return (records*5+1)*idSize + partitions*partitionSize
+}
+
+func cubeEstimate(s *ColumnStore) int {
+	// the cube has no more cells per date than the store has records
+	partitions := len(s.Partitions)
+	if partitions == 0 {
+		partitions = s.Len()
+	}
+	return cubeSize(s.Len(), partitions)
+}
+
+// upsertEstimate is the most that applying the rows can add while the
+// current version is held: the delta and the values it may add, the copies
+// of what is modified in place or outgrows its capacity, and each index
+// that is extended or rebuilt, keyed by name.
+func (p *Planner) upsertEstimate(rows []Row) (int, map[string]int) {
+	s, db := p.Store, p.Store.db
+	records, ids := s.Len()+len(rows), 0
+	// the delta is held as a store and appended to the copy, which only adds
+	// the values and mutations the database lacks, once each
+	n := 0
+	newValues, newMutations := make(map[string]bool), make(map[string]bool)
+	addValue := func(v string) {
+		if _, ok := db.ValueLookup[v]; !ok && !newValues[v] {
+			newValues[v] = true
+			n += len(v)
+		}
+	}
+	for i := range rows {
+		r := &rows[i]
+		n += 2 * (4 + len(db.Columns) + len(r.Mutations)) * idSize
+		addValue(r.Area)
+		addValue(r.Date)
+		addValue(r.PangoClade)
+		for _, v := range r.Metadata {
+			addValue(v)
+		}
+		for _, m := range r.Mutations {
+			if _, ok := db.MutationLookup[m]; !ok && !newMutations[m] {
+				newMutations[m] = true
+				n += len(m)
+			}
+		}
+		ids += len(r.Mutations)
+	}
+	values, mutations := len(db.Values)+len(newValues), len(db.Mutations)+len(newMutations)
+	n += len(newValues)*(int(unsafe.Sizeof(Value{}))+stringSize+intSize) +
+		len(newMutations)*(int(unsafe.Sizeof(Mutation{}))+stringSize+intSize)
+	n += mapSize(values, stringSize+intSize) + mapSize(mutations, stringSize+intSize) + mapSize(len(db.Genes), stringSize+1)
+	// the metadata, counts, deleted and partitions are copied, and appending
+	// may reallocate the other columns
+	n += (len(db.Columns)+1)*records*idSize + (records/64+1)*8 + s.partitionsSize()
+	n += (4*records + len(s.MutationIds) + ids) * idSize
+
+	indexes := make(map[string]int)
+	if p.Mutations != nil {
+		indexes["mutations"] = mutations*sliceSize + mapSize(mutations, stringSize+idSize) + ids*idSize
+	}
+	if p.Clades != nil {
+		indexes["clades"] = cladeIndexSize(records, values)
+	}
+	if p.Cube != nil {
+		partitions := len(s.Partitions) + len(rows)
+		if len(s.Partitions) == 0 {
+			partitions = records
+		}
+		indexes["cube"] = cubeSize(records, partitions)
+	}
+	return n, indexes
+}
+
+// Footprint estimates the bytes held by the database, store and indexes.
+func (p *Planner) Footprint() Footprint {
+	s, db := p.Store, p.Store.db
+	f := Footprint{
+		Values:    db.valuesSize(),
+		Mutations: db.mutationsSize(),
+		Records:   s.Size() + db.recordsSize(),
+		Indexes:   map[string]int{"partitions": s.partitionsSize()},
+	}
+	if p.Mutations != nil {
+		f.Indexes["mutations"] = p.Mutations.size()
+	}
+	if p.Clades != nil {
+		f.Indexes["clades"] = p.Clades.size()
+	}
+	if p.Cube != nil {
+		f.Indexes["cube"] = p.Cube.Size() + p.Cube.partitionsSize()
+	}
+	f.Total = f.Values + f.Mutations + f.Records
+	for _, n := range f.Indexes {
+		f.Total += n
+	}
+	return f
+}
+
+// IndexWithin builds the mutation index, clade index and cube, in that
+// order, skipping any that would take the footprint over limit bytes, unless
+// the limit is zero. It returns the names of those skipped.
+func (p *Planner) IndexWithin(limit int) []string {
+	s := p.Store
+	var skipped []string
+	for _, index := range []struct {
+		name     string
+		estimate func(s *ColumnStore) int
+		build    func()
+	}{
+		{"mutations", mutationIndexEstimate, func() { p.Mutations = CreateMutationIndex(s) }},
+		{"clades", cladeIndexEstimate, func() { p.Clades = CreateCladeIndex(s) }},
+		{"cube", cubeEstimate, func() { p.Cube = s.Cube() }},
+	} {
+		if limit > 0 && p.Footprint().Total+index.estimate(s) > limit {
+			skipped = append(skipped, index.name)
+			continue
+		}
+		index.build()
+	}
+	return skipped
+}
@@ -0,0 +1,139 @@
+package covince
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFootprint(t *testing.T) {
+	s := testColumnStore(testDatabase(2000))
+	s.Partition()
+	p := &Planner{Store: s}
+
+	f := p.Footprint()
+	assert.Equal(t, s.Size()+s.db.recordsSize(), f.Records)
+	assert.Equal(t, map[string]int{"partitions": s.partitionsSize()}, f.Indexes)
+	assert.Equal(t, f.Values+f.Mutations+f.Records+f.Indexes["partitions"], f.Total)
+
+	estimates := map[string]int{
+		"mutations": mutationIndexEstimate(s),
+		"clades":    cladeIndexEstimate(s),
+		"cube":      cubeEstimate(s),
+	}
+	assert.Empty(t, p.IndexWithin(0))
+	f = p.Footprint()
+	for name, estimate := range estimates {
+		assert.Greater(t, f.Indexes[name], 0, name)
+		assert.GreaterOrEqual(t, estimate, f.Indexes[name], name)
+	}
+	total := f.Values + f.Mutations + f.Records
+	for _, n := range f.Indexes {
+		total += n
+	}
+	assert.Equal(t, total, f.Total)
+}
+
+func TestIndexWithin(t *testing.T) {
+	s := testColumnStore(testDatabase(2000))
+	s.Partition()
+	p := &Planner{Store: s}
+	limit := p.Footprint().Total + mutationIndexEstimate(s) + 1
+
+	assert.Equal(t, []string{"clades", "cube"}, p.IndexWithin(limit))
+	assert.NotNil(t, p.Mutations)
+	assert.Nil(t, p.Clades)
+	assert.Nil(t, p.Cube)
+	assert.LessOrEqual(t, p.Footprint().Total, limit)
+}
+
+func TestUpsertLimit(t *testing.T) {
+	d := testDataset(2000)
+	current := d.Current()
+	d.Limit = current.Planner.Footprint().Total
+
+	rows := make([]Row, 100)
+	for i := range rows {
+		rows[i] = Row{Area: "E1", Date: "2021-02-01", PangoClade: "C.", Metadata: []string{"hospital"}, Mutations: []string{"S:" + string(rune('a'+i%26))}, Count: i}
+		rows[i].Area += string(rune('a' + i/26))
+	}
+	_, err := d.Upsert(rows, ":", 0)
+	assert.True(t, errors.Is(err, ErrMemoryLimit))
+	assert.Contains(t, err.Error(), "estimated")
+	assert.Same(t, current, d.Current())
+
+	data, indexes := current.Planner.upsertEstimate(rows)
+	assert.Equal(t, []string{"clades", "cube", "mutations"}, sortedKeys(indexes))
+
+	t.Run("the clade index and cube are dropped to stay within the limit", func(t *testing.T) {
+		d := testDataset(2000)
+		d.Limit = current.Planner.Footprint().Total + data + indexes["mutations"] + 1
+		result, err := d.Upsert(rows, ":", 0)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"clades", "cube"}, result.Dropped)
+		p := d.Current().Planner
+		assert.NotNil(t, p.Mutations)
+		assert.Nil(t, p.Clades)
+		assert.Nil(t, p.Cube)
+		q := Query{Lineages: []QueryLineage{{Key: "C", PangoClade: "C."}}}
+		assert.Equal(t, totalCount(t, p.Store.Scan(2), &q), totalCount(t, p.Plan(&q, true).Scan, &q))
+	})
+
+	t.Run("values and mutations already held are not charged", func(t *testing.T) {
+		d := testDataset(2000)
+		p := d.Current().Planner
+		var existing, renamed []Row
+		p.Store.Iterate(context.Background(), 0, 100, func(r *Record) {
+			row := Row{Area: r.Area.Value, Date: r.Date.Value, PangoClade: r.PangoClade.Value, Count: r.Count + 1}
+			for _, v := range r.Metadata {
+				row.Metadata = append(row.Metadata, v.Value)
+			}
+			for _, m := range r.Mutations {
+				row.Mutations = append(row.Mutations, m.Key)
+			}
+			existing = append(existing, row)
+			// the same delta with keys of the same length that are all new
+			rename := func(v string) string { return "x" + v[1:] }
+			row.Area, row.PangoClade = rename(row.Area), rename(row.PangoClade)
+			row.Mutations = append([]string{}, row.Mutations...)
+			for i := range row.Mutations {
+				row.Mutations[i] = rename(row.Mutations[i])
+			}
+			renamed = append(renamed, row)
+		})
+		data, indexes := p.upsertEstimate(existing)
+		renamedData, _ := p.upsertEstimate(renamed)
+		assert.Less(t, data, renamedData)
+
+		d.Limit = p.Footprint().Total + renamedData - 1
+		for _, n := range indexes {
+			d.Limit += n
+		}
+		result, err := d.Upsert(existing, ":", 0)
+		assert.Nil(t, err)
+		assert.Empty(t, result.Dropped)
+	})
+
+	d.Limit = 0
+	_, err = d.Upsert(rows, ":", 0)
+	assert.Nil(t, err)
+	f := d.Current().Planner.Footprint()
+	// the estimate bounds the growth of the new version
+	estimate := current.Planner.Footprint().Total + data
+	for _, n := range indexes {
+		estimate += n
+	}
+	assert.LessOrEqual(t, f.Total, estimate)
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
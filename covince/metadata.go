@@ -0,0 +1,82 @@
+package covince
+
+import (
+	"context"
+	"sort"
+)
+
+type MetadataFilter struct {
+	Column int
+	Values map[string]bool
+}
+
+// Dimension returns the group a record belongs to when breaking down results.
+type Dimension func(r *Record) string
+
+func DateDimension(r *Record) string {
+	return r.Date.Value
+}
+
+func AreaDimension(r *Record) string {
+	return r.Area.Value
+}
+
+func MetadataDimension(column int) Dimension {
+	return func(r *Record) string {
+		return r.Metadata[column].Value
+	}
+}
+
+func (db *Database) IndexMetadata(values []string) []*Value {
+	ptrs := make([]*Value, len(values))
+	for i, v := range values {
+		ptrs[i] = db.IndexValue(v)
+	}
+	return ptrs
+}
+
+func DistinctValues(foreach IteratorFunc, d Dimension) []string {
+	values := make(map[string]bool)
+	foreach(func(r *Record) {
+		values[d(r)] = true
+	}, -1)
+	valueArray := make([]string, len(values))
+	i := 0
+	for k := range values {
+		valueArray[i] = k
+		i++
+	}
+	sort.Strings(valueArray)
+	return valueArray
+}
+
+// DistinctValuesBy finds the sorted distinct values of several dimensions in
+// one pass, split across threads.
+func DistinctValuesBy(ctx context.Context, scan ContextIteratorFunc, threads int, dimensions map[string]Dimension) (map[string][]string, error) {
+	p, err := MapReduce(ctx, scan, threads, func() Partial {
+		return NewGroupedCountsPartial(func(m map[string]map[string]int, r *Record) {
+			for name, d := range dimensions {
+				values, ok := m[name]
+				if !ok {
+					values = make(map[string]int)
+					m[name] = values
+				}
+				values[d(r)] += r.Count
+			}
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	distinct := make(map[string][]string, len(dimensions))
+	for name := range dimensions {
+		values := p.(*GroupedCountsPartial).Groups[name]
+		valueArray := make([]string, 0, len(values))
+		for k := range values {
+			valueArray = append(valueArray, k)
+		}
+		sort.Strings(valueArray)
+		distinct[name] = valueArray
+	}
+	return distinct, nil
+}
@@ -0,0 +1,54 @@
+package covince
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testMetadataRecords = []Record{
+	{PangoClade: value("B."), Date: value("2020-09-01"), Area: value("A"), Count: 1, Metadata: []*Value{value("hospital")}},
+	{PangoClade: value("B.1."), Date: value("2020-09-01"), Area: value("A"), Count: 2, Metadata: []*Value{value("community")}},
+	{PangoClade: value("B.1."), Date: value("2020-10-01"), Area: value("B"), Count: 3, Metadata: []*Value{value("hospital")}},
+}
+
+func TestIndexMetadata(t *testing.T) {
+	db := CreateDatabase()
+	a := db.IndexMetadata([]string{"hospital", "18-30"})
+	b := db.IndexMetadata([]string{"hospital", "31-50"})
+	assert.Equal(t, "hospital", a[0].Value)
+	assert.Equal(t, "31-50", b[1].Value)
+	assert.Len(t, db.Values, 3)
+}
+
+func TestMetadataFilter(t *testing.T) {
+	m := map[string]int{}
+	q := Query{
+		Metadata: []MetadataFilter{{Column: 0, Values: map[string]bool{"hospital": true}}},
+	}
+	for _, r := range testMetadataRecords {
+		Lineages(m, &q, &r)
+	}
+	assert.Equal(t, map[string]int{"B.": 1, "B.1.": 3}, m)
+}
+
+func TestLineagesBy(t *testing.T) {
+	m := map[string]map[string]int{}
+	q := Query{}
+	for _, r := range testMetadataRecords {
+		LineagesBy(m, &q, MetadataDimension(0), &r)
+	}
+	assert.Equal(t, map[string]map[string]int{
+		"hospital":  {"B.": 1, "B.1.": 3},
+		"community": {"B.1.": 2},
+	}, m)
+}
+
+func TestDistinctValues(t *testing.T) {
+	foreach := func(agg func(r *Record), sliceNum int) {
+		for _, r := range testMetadataRecords {
+			agg(&r)
+		}
+	}
+	assert.Equal(t, []string{"community", "hospital"}, DistinctValues(foreach, MetadataDimension(0)))
+}
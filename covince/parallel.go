@@ -0,0 +1,216 @@
+package covince
+
+import (
+	"context"
+	"sync"
+)
+
+// Partial accumulates the records of one slice, and is then merged with the
+// partials of the other slices.
+type Partial interface {
+	Aggregate(r *Record)
+	Merge(other Partial)
+}
+
+// SliceBounds divides n records into the given number of slices, returning
+// the range of the slice at sliceIndex. A sliceIndex of -1 is every record.
+func SliceBounds(n int, sliceIndex int, slices int) (int, int) {
+	if sliceIndex == -1 || slices <= 1 {
+		return 0, n
+	}
+	size := (n + slices - 1) / slices
+	start := sliceIndex * size
+	if start > n {
+		start = n
+	}
+	end := start + size
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+// MapReduce aggregates each slice into its own partial in parallel, then
+// merges them. The result is identical to aggregating every record serially.
+func MapReduce(ctx context.Context, scan ContextIteratorFunc, threads int, newPartial func() Partial) (Partial, error) {
+	if threads <= 1 {
+		p := newPartial()
+		if err := scan(ctx, p.Aggregate, -1); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	partials := make([]Partial, threads)
+	errs := make([]error, threads)
+	var wg sync.WaitGroup
+	wg.Add(threads)
+	for i := 0; i < threads; i++ {
+		go func(slice int) {
+			p := newPartial()
+			partials[slice] = p
+			errs[slice] = scan(ctx, p.Aggregate, slice)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range partials[1:] {
+		partials[0].Merge(p)
+	}
+	return partials[0], nil
+}
+
+func (i Index) Merge(other Index) {
+	for date, counts := range other {
+		dateCounts, ok := i[date]
+		if !ok {
+			i[date] = counts
+			continue
+		}
+		for k, count := range counts {
+			dateCounts[k] += count
+		}
+	}
+}
+
+func mergeCounts(m map[string]int, other map[string]int) {
+	for k, count := range other {
+		m[k] += count
+	}
+}
+
+type IndexPartial struct {
+	Index     Index
+	aggregate func(i Index, r *Record)
+}
+
+func NewIndexPartial(aggregate func(i Index, r *Record)) *IndexPartial {
+	return &IndexPartial{Index: make(Index), aggregate: aggregate}
+}
+
+func (p *IndexPartial) Aggregate(r *Record) { p.aggregate(p.Index, r) }
+func (p *IndexPartial) Merge(other Partial) { p.Index.Merge(other.(*IndexPartial).Index) }
+
+type GroupedIndexPartial struct {
+	Groups    map[string]Index
+	aggregate func(m map[string]Index, r *Record)
+}
+
+func NewGroupedIndexPartial(aggregate func(m map[string]Index, r *Record)) *GroupedIndexPartial {
+	return &GroupedIndexPartial{Groups: make(map[string]Index), aggregate: aggregate}
+}
+
+func (p *GroupedIndexPartial) Aggregate(r *Record) { p.aggregate(p.Groups, r) }
+func (p *GroupedIndexPartial) Merge(other Partial) {
+	for k, i := range other.(*GroupedIndexPartial).Groups {
+		if existing, ok := p.Groups[k]; ok {
+			existing.Merge(i)
+		} else {
+			p.Groups[k] = i
+		}
+	}
+}
+
+type CountsPartial struct {
+	Counts    map[string]int
+	aggregate func(m map[string]int, r *Record)
+}
+
+func NewCountsPartial(aggregate func(m map[string]int, r *Record)) *CountsPartial {
+	return &CountsPartial{Counts: make(map[string]int), aggregate: aggregate}
+}
+
+func (p *CountsPartial) Aggregate(r *Record) { p.aggregate(p.Counts, r) }
+func (p *CountsPartial) Merge(other Partial) { mergeCounts(p.Counts, other.(*CountsPartial).Counts) }
+
+type GroupedCountsPartial struct {
+	Groups    map[string]map[string]int
+	aggregate func(m map[string]map[string]int, r *Record)
+}
+
+func NewGroupedCountsPartial(aggregate func(m map[string]map[string]int, r *Record)) *GroupedCountsPartial {
+	return &GroupedCountsPartial{Groups: make(map[string]map[string]int), aggregate: aggregate}
+}
+
+func (p *GroupedCountsPartial) Aggregate(r *Record) { p.aggregate(p.Groups, r) }
+func (p *GroupedCountsPartial) Merge(other Partial) {
+	for k, counts := range other.(*GroupedCountsPartial).Groups {
+		if existing, ok := p.Groups[k]; ok {
+			mergeCounts(existing, counts)
+		} else {
+			p.Groups[k] = counts
+		}
+	}
+}
+
+type AggregatePartial struct {
+	Index     AggregateIndex
+	aggregate func(i AggregateIndex, r *Record)
+}
+
+func NewAggregatePartial(aggregate func(i AggregateIndex, r *Record)) *AggregatePartial {
+	return &AggregatePartial{Index: make(AggregateIndex), aggregate: aggregate}
+}
+
+func (p *AggregatePartial) Aggregate(r *Record) { p.aggregate(p.Index, r) }
+func (p *AggregatePartial) Merge(other Partial) {
+	for k, row := range other.(*AggregatePartial).Index {
+		if existing, ok := p.Index[k]; ok {
+			existing.Count += row.Count
+		} else {
+			p.Index[k] = row
+		}
+	}
+}
+
+// MutationsPartial accumulates a mutation search. Growth is summed along
+// with the counts, so merged partials sort the same as a serial search.
+type MutationsPartial struct {
+	Mutations map[string]*MutationSearch
+	Total     MutationSearch
+	so        *SearchOpts
+	q         *Query
+}
+
+func NewMutationsPartial(so *SearchOpts, q *Query) *MutationsPartial {
+	return &MutationsPartial{Mutations: make(map[string]*MutationSearch), so: so, q: q}
+}
+
+func (p *MutationsPartial) Aggregate(r *Record) { Mutations(p.Mutations, &p.Total, p.so, p.q, r) }
+func (p *MutationsPartial) Merge(other Partial) {
+	o := other.(*MutationsPartial)
+	for k, v := range o.Mutations {
+		if sr, ok := p.Mutations[k]; ok {
+			sr.Count += v.Count
+			sr.growthStart += v.growthStart
+			sr.growthEnd += v.growthEnd
+		} else {
+			p.Mutations[k] = v
+		}
+	}
+	p.Total.Count += o.Total.Count
+	p.Total.growthStart += o.Total.growthStart
+	p.Total.growthEnd += o.Total.growthEnd
+}
+
+// Partials aggregates several partials in the same pass.
+type Partials []Partial
+
+func (p Partials) Aggregate(r *Record) {
+	for _, partial := range p {
+		partial.Aggregate(r)
+	}
+}
+
+func (p Partials) Merge(other Partial) {
+	o := other.(Partials)
+	for i, partial := range p {
+		partial.Merge(o[i])
+	}
+}
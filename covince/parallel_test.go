@@ -0,0 +1,111 @@
+package covince
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testScan(records []Record, slices int) ContextIteratorFunc {
+	return func(ctx context.Context, agg func(r *Record), sliceIndex int) error {
+		from, to := SliceBounds(len(records), sliceIndex, slices)
+		return IterateRecords(ctx, records[from:to], agg)
+	}
+}
+
+func partialResults(p Partial) []interface{} {
+	partials := p.(Partials)
+	return []interface{}{
+		partials[0].(*IndexPartial).Index,
+		partials[1].(*CountsPartial).Counts,
+		partials[2].(*GroupedIndexPartial).Groups,
+		partials[3].(*AggregatePartial).Index,
+	}
+}
+
+func TestSliceBounds(t *testing.T) {
+	from, to := SliceBounds(10, -1, 4)
+	assert.Equal(t, []int{0, 10}, []int{from, to})
+	from, to = SliceBounds(10, 0, 4)
+	assert.Equal(t, []int{0, 3}, []int{from, to})
+	from, to = SliceBounds(10, 3, 4)
+	assert.Equal(t, []int{9, 10}, []int{from, to})
+	from, to = SliceBounds(2, 3, 4)
+	assert.Equal(t, []int{2, 2}, []int{from, to})
+}
+
+func TestMapReduce(t *testing.T) {
+	q := Query{
+		Lineages: []QueryLineage{
+			{Key: "B.1", PangoClade: "B.1."},
+			{Key: "B", PangoClade: "B."},
+		},
+	}
+	records := append(append([]Record{}, testRecords...), testRecords...)
+
+	newPartial := func() Partial {
+		return Partials{
+			NewIndexPartial(func(i Index, r *Record) { Frequency(i, &q, r) }),
+			NewCountsPartial(func(m map[string]int, r *Record) { Lineages(m, &q, r) }),
+			NewGroupedIndexPartial(func(m map[string]Index, r *Record) { FrequencyBy(m, &q, AreaDimension, r) }),
+			NewAggregatePartial(func(i AggregateIndex, r *Record) {
+				Aggregate(i, &q, []GroupBy{{Name: "area", Kind: GROUP_BY_DIMENSION, Dimension: AreaDimension}}, r)
+			}),
+		}
+	}
+
+	serial, err := MapReduce(context.Background(), testScan(records, 1), 1, newPartial)
+	assert.Nil(t, err)
+	for _, threads := range []int{2, 3, 8} {
+		parallel, err := MapReduce(context.Background(), testScan(records, threads), threads, newPartial)
+		assert.Nil(t, err)
+		assert.Equal(t, partialResults(serial), partialResults(parallel))
+	}
+	assert.Equal(t, Index{
+		"2020-09-01": {"B": 2},
+		"2020-10-01": {"B.1": 4},
+		"2020-11-01": {"B.1": 6},
+	}, partialResults(serial)[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = MapReduce(ctx, testScan(records, 2), 2, newPartial)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestEmergingSearchContext(t *testing.T) {
+	records := append(append([]Record{}, testRecords...), testRecords...)
+	q := Query{DateFrom: "2020-11-01", DateTo: "2020-11-01"}
+	opts := EmergingOpts{Baseline: DateRange{From: "2020-09-01", To: "2020-10-01"}}
+
+	serial := EmergingSearch(testScan(records, 1).Bind(context.Background()), &q, &opts)
+	parallel, err := EmergingSearchContext(context.Background(), testScan(records, 3), 3, &q, &opts)
+	assert.Nil(t, err)
+	assert.Equal(t, serial, parallel)
+}
+
+func TestParallelSearchMutations(t *testing.T) {
+	records := append(append([]Record{}, testRecords...), testRecords...)
+	q := Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}
+	so := SearchOpts{Lineage: "B", Limit: 20, SortProperty: "count", SortDirection: "desc"}
+
+	serial := SearchMutations(testScan(records, 1).Bind(context.Background()), &q, &so)
+	assert.NotEmpty(t, serial.Page)
+	so.Threads = 3
+	parallel, err := SearchMutationsContext(context.Background(), testScan(records, 3), &q, &so)
+	assert.Nil(t, err)
+	assert.Equal(t, serial, parallel)
+}
+
+func TestDistinctValuesBy(t *testing.T) {
+	distinct, err := DistinctValuesBy(context.Background(), testScan(testRecords, 2), 2, map[string]Dimension{
+		"dates": DateDimension,
+		"areas": AreaDimension,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"dates": {"2020-09-01", "2020-10-01", "2020-11-01"},
+		"areas": {"A", "B", "C"},
+	}, distinct)
+}
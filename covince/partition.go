@@ -0,0 +1,248 @@
+package covince
+
+import (
+	"context"
+	"sort"
+)
+
+// the most records in a partition, which never spans more than one date
+const PARTITION_SIZE = 1024
+
+// Partition is a run of records, sorted by date then area, with the bounds
+// of its values so that filters can skip it entirely.
+type Partition struct {
+	From    int
+	To      int
+	MinDate string
+	MaxDate string
+	MinArea string
+	MaxArea string
+}
+
+type recordRange struct {
+	from int
+	to   int
+}
+
+func (s *ColumnStore) value(id uint32) string {
+	return s.db.Values[id].Value
+}
+
+func (s *ColumnStore) before(i int, j int) bool {
+	if s.Dates[i] != s.Dates[j] {
+		return s.value(s.Dates[i]) < s.value(s.Dates[j])
+	}
+	return s.value(s.Areas[i]) < s.value(s.Areas[j])
+}
+
+// sortByDateAndArea orders the records stably, unless they already are.
+func (s *ColumnStore) sortByDateAndArea() {
+	sorted := true
+	for i := 1; i < s.Len() && sorted; i++ {
+		sorted = !s.before(i, i-1)
+	}
+	if sorted {
+		return
+	}
+	order := make([]int, s.Len())
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return s.before(order[a], order[b]) })
+	s.permute(order)
+}
+
+// Partition sorts the records by date and area and divides them into
+// partitions. Any index of record ids must be created afterwards.
+func (s *ColumnStore) Partition() {
+	s.sortByDateAndArea()
+	s.Partitions = nil
+	s.partitionFrom(0)
+}
+
+// partitionFrom divides the records from the given one, which must already
+// be sorted, into partitions following any existing ones.
+func (s *ColumnStore) partitionFrom(from int) {
+	for i := from; i < s.Len(); i++ {
+		date, area := s.value(s.Dates[i]), s.value(s.Areas[i])
+		n := len(s.Partitions)
+		if i == from || s.Partitions[n-1].MaxDate != date || i-s.Partitions[n-1].From == PARTITION_SIZE {
+			s.Partitions = append(s.Partitions, Partition{
+				From: i, To: i + 1,
+				MinDate: date, MaxDate: date,
+				MinArea: area, MaxArea: area,
+			})
+			continue
+		}
+		p := &s.Partitions[n-1]
+		p.To = i + 1
+		p.MaxArea = area
+	}
+}
+
+func permuteIds(column []uint32, order []int) []uint32 {
+	permuted := make([]uint32, len(order))
+	for i, j := range order {
+		permuted[i] = column[j]
+	}
+	return permuted
+}
+
+// permute reorders the records, leaving out any not in order.
+func (s *ColumnStore) permute(order []int) {
+	s.Dates = permuteIds(s.Dates, order)
+	s.Areas = permuteIds(s.Areas, order)
+	s.PangoClades = permuteIds(s.PangoClades, order)
+	for c, column := range s.Metadata {
+		s.Metadata[c] = permuteIds(column, order)
+	}
+	counts := make([]int32, len(order))
+	offsets := make([]uint32, 1, len(order)+1)
+	ids := make([]uint32, 0, len(s.MutationIds))
+	for i, j := range order {
+		counts[i] = s.Counts[j]
+		ids = append(ids, s.MutationIds[s.MutationOffsets[j]:s.MutationOffsets[j+1]]...)
+		offsets = append(offsets, uint32(len(ids)))
+	}
+	s.Counts, s.MutationOffsets, s.MutationIds = counts, offsets, ids
+	if s.Deleted != nil {
+		deleted := s.Deleted
+		s.Deleted = nil
+		for i, j := range order {
+			if isSet(deleted, j) {
+				s.setDeleted(i, true)
+			}
+		}
+	}
+}
+
+func (p *Partition) matches(q *Query) bool {
+	if q.DateFrom != "" && p.MaxDate < q.DateFrom {
+		return false
+	}
+	if q.DateTo != "" && p.MinDate > q.DateTo {
+		return false
+	}
+	if q.Area != "" && q.Area != "overview" && (q.Area < p.MinArea || q.Area > p.MaxArea) {
+		return false
+	}
+	if q.AreaSet != nil {
+		found := false
+		for area := range q.AreaSet {
+			if area >= p.MinArea && area <= p.MaxArea {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if p.MinArea == p.MaxArea && q.ExcludedAreas[p.MinArea] {
+		return false
+	}
+	return true
+}
+
+// prune returns the ranges of the partitions that the query can match,
+// merging adjacent ones, or false if nothing was pruned.
+func (s *ColumnStore) prune(q *Query) ([]recordRange, bool) {
+	if s.Partitions == nil {
+		return nil, false
+	}
+	var ranges []recordRange
+	pruned := false
+	for i := range s.Partitions {
+		p := &s.Partitions[i]
+		if !p.matches(q) {
+			pruned = true
+			continue
+		}
+		if n := len(ranges); n > 0 && ranges[n-1].to == p.From {
+			ranges[n-1].to = p.To
+		} else {
+			ranges = append(ranges, recordRange{p.From, p.To})
+		}
+	}
+	return ranges, pruned
+}
+
+func withinRanges(ids []uint32, ranges []recordRange) []uint32 {
+	result := make([]uint32, 0, len(ids))
+	j := 0
+	for _, id := range ids {
+		for j < len(ranges) && int(id) >= ranges[j].to {
+			j++
+		}
+		if j == len(ranges) {
+			break
+		}
+		if int(id) >= ranges[j].from {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// sliceRanges divides the records of the ranges evenly between slices.
+func sliceRanges(ranges []recordRange, sliceIndex int, slices int) []recordRange {
+	total := 0
+	for _, r := range ranges {
+		total += r.to - r.from
+	}
+	from, to := SliceBounds(total, sliceIndex, slices)
+	var sliced []recordRange
+	offset := 0
+	for _, r := range ranges {
+		n := r.to - r.from
+		start, end := from-offset, to-offset
+		offset += n
+		if start < 0 {
+			start = 0
+		}
+		if end > n {
+			end = n
+		}
+		if start < end {
+			sliced = append(sliced, recordRange{r.from + start, r.from + end})
+		}
+	}
+	return sliced
+}
+
+func (s *ColumnStore) idsScan(ids []uint32, slices int) ContextIteratorFunc {
+	return func(ctx context.Context, aggregationFunc func(r *Record), sliceIndex int) error {
+		from, to := SliceBounds(len(ids), sliceIndex, slices)
+		return s.IterateIds(ctx, ids[from:to], aggregationFunc)
+	}
+}
+
+func (s *ColumnStore) rangesScan(ranges []recordRange, slices int) ContextIteratorFunc {
+	return func(ctx context.Context, aggregationFunc func(r *Record), sliceIndex int) error {
+		for _, r := range sliceRanges(ranges, sliceIndex, slices) {
+			if err := s.Iterate(ctx, r.from, r.to, aggregationFunc); err != nil {
+				return err
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// Select returns a scan of only the records that can match the query,
+// intersecting the candidates of the mutation and clade indexes, if given,
+// with the partitions that the query's dates and areas do not rule out. It
+// returns false when nothing narrows the scan.
+func (s *ColumnStore) Select(idx *MutationIndex, clades *CladeIndex, q *Query, slices int) (ContextIteratorFunc, bool) {
+	ranges, pruned := s.prune(q)
+	candidates, indexed := s.candidates(idx, clades, q.Lineages)
+	if indexed {
+		if pruned {
+			candidates = withinRanges(candidates, ranges)
+		}
+		return s.idsScan(candidates, slices), true
+	}
+	if pruned {
+		return s.rangesScan(ranges, slices), true
+	}
+	return nil, false
+}
@@ -0,0 +1,147 @@
+package covince
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartition(t *testing.T) {
+	db := testDatabase(5000)
+	s := testColumnStore(db)
+	s.Partition()
+
+	total := 0
+	for i, p := range s.Partitions {
+		assert.Equal(t, p.MinDate, p.MaxDate)
+		assert.True(t, p.To-p.From <= PARTITION_SIZE)
+		assert.True(t, p.MinArea <= p.MaxArea)
+		if i > 0 {
+			assert.Equal(t, s.Partitions[i-1].To, p.From)
+			assert.True(t, s.Partitions[i-1].MaxDate <= p.MinDate)
+		}
+		total += p.To - p.From
+	}
+	assert.Equal(t, s.Len(), total)
+
+	// sorting keeps each record's mutations and counts together
+	unsorted := testColumnStore(db)
+	for _, q := range []Query{
+		{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}},
+		{Lineages: []QueryLineage{{Key: "B+S:1", PangoClade: "B.", Mutations: []Mutation{{Prefix: "S", Suffix: "1"}}}}},
+	} {
+		q := q
+		newPartial := func() Partial {
+			return NewIndexPartial(func(i Index, r *Record) { Frequency(i, &q, r) })
+		}
+		expected, _ := MapReduce(context.Background(), unsorted.Scan(1), 1, newPartial)
+		actual, _ := MapReduce(context.Background(), s.Scan(2), 2, newPartial)
+		assert.Equal(t, expected.(*IndexPartial).Index, actual.(*IndexPartial).Index)
+	}
+}
+
+func TestPartitionDeleted(t *testing.T) {
+	s := testColumnStore(testDatabase(200))
+	s.setDeleted(1, true)
+	s.setDeleted(130, true)
+	keys := map[string]bool{s.key(1): true, s.key(130): true}
+	s.Partition()
+
+	assert.Equal(t, 2, s.deletedCount())
+	for i := 0; i < s.Len(); i++ {
+		assert.Equal(t, keys[s.key(i)], s.isDeleted(i))
+	}
+	n := 0
+	s.Iterate(context.Background(), 0, s.Len(), func(r *Record) { n++ })
+	assert.Equal(t, 198, n)
+}
+
+func TestPartitionMatches(t *testing.T) {
+	p := Partition{MinDate: "2021-01-02", MaxDate: "2021-01-02", MinArea: "E2", MaxArea: "E5"}
+	assert.True(t, p.matches(&Query{DateFrom: "2021-01-01", DateTo: "2021-01-02", Area: "E3"}))
+	assert.False(t, p.matches(&Query{DateFrom: "2021-01-03"}))
+	assert.False(t, p.matches(&Query{DateTo: "2021-01-01"}))
+	assert.False(t, p.matches(&Query{Area: "E6"}))
+	assert.True(t, p.matches(&Query{Area: "overview"}))
+	assert.False(t, p.matches(&Query{AreaSet: map[string]bool{"E1": true, "E6": true}}))
+	assert.True(t, p.matches(&Query{ExcludedAreas: map[string]bool{"E2": true}}))
+	p.MaxArea = "E2"
+	assert.False(t, p.matches(&Query{ExcludedAreas: map[string]bool{"E2": true}}))
+}
+
+func TestSliceRanges(t *testing.T) {
+	ranges := []recordRange{{0, 3}, {10, 12}, {20, 25}}
+	assert.Equal(t, ranges, sliceRanges(ranges, -1, 2))
+	assert.Equal(t, []recordRange{{0, 3}, {10, 11}}, sliceRanges(ranges, 0, 3))
+	assert.Equal(t, []recordRange{{11, 12}, {20, 23}}, sliceRanges(ranges, 1, 3))
+	assert.Equal(t, []recordRange{{23, 25}}, sliceRanges(ranges, 2, 3))
+	assert.Equal(t, []uint32{1, 11, 24}, withinRanges([]uint32{1, 5, 11, 12, 19, 24, 30}, ranges))
+}
+
+func TestSelect(t *testing.T) {
+	db := testDatabase(5000)
+	s := testColumnStore(db)
+	s.Partition()
+	idx := CreateMutationIndex(s)
+
+	_, ok := s.Select(idx, nil, &Query{}, 1)
+	assert.False(t, ok)
+
+	groups := []GroupBy{
+		{Name: "date", Dimension: DateDimension},
+		{Name: "lineage", Kind: GROUP_BY_LINEAGE},
+	}
+
+	for _, q := range []Query{
+		{DateFrom: "2021-01-03", DateTo: "2021-01-05"},
+		{Area: "E7", DateTo: "2021-01-08"},
+		{AreaSet: map[string]bool{"E1": true, "E250": true}, DateFrom: "2021-01-20"},
+		{
+			Lineages: []QueryLineage{{Key: "B+S:1", PangoClade: "B.", Mutations: []Mutation{{Prefix: "S", Suffix: "1"}}}},
+			DateTo:   "2021-01-10",
+		},
+	} {
+		q := q
+		newPartial := func() Partial {
+			return NewAggregatePartial(func(i AggregateIndex, r *Record) { Aggregate(i, &q, groups, r) })
+		}
+		expected, _ := MapReduce(context.Background(), s.Scan(1), 1, newPartial)
+		scan, ok := s.Select(idx, nil, &q, 3)
+		assert.True(t, ok)
+		var visited int64
+		counted := func(ctx context.Context, agg func(r *Record), sliceIndex int) error {
+			return scan(ctx, func(r *Record) { atomic.AddInt64(&visited, 1); agg(r) }, sliceIndex)
+		}
+		actual, err := MapReduce(context.Background(), counted, 3, newPartial)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, expected.(*AggregatePartial).Index)
+		assert.Equal(t, expected.(*AggregatePartial).Index.Table(groups), actual.(*AggregatePartial).Index.Table(groups))
+		assert.True(t, int(visited) < s.Len())
+	}
+}
+
+var benchmarkWindowQuery = Query{DateFrom: "2021-01-10", DateTo: "2021-01-11", Area: "E100"}
+
+func BenchmarkWindowFullScan(b *testing.B) {
+	s := testColumnStore(testDatabase(BENCHMARK_RECORDS))
+	s.Partition()
+	scan := s.Scan(1)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		m := make(map[string]int)
+		scan(context.Background(), func(r *Record) { Lineages(m, &benchmarkWindowQuery, r) }, -1)
+	}
+}
+
+func BenchmarkWindowPrunedScan(b *testing.B) {
+	s := testColumnStore(testDatabase(BENCHMARK_RECORDS))
+	s.Partition()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		m := make(map[string]int)
+		scan, _ := s.Select(nil, nil, &benchmarkWindowQuery, 1)
+		scan(context.Background(), func(r *Record) { Lineages(m, &benchmarkWindowQuery, r) }, -1)
+	}
+}
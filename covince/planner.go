@@ -0,0 +1,121 @@
+package covince
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+const (
+	PLAN_SCAN       = "scan"
+	PLAN_PARTITIONS = "partitions"
+	PLAN_INDEX      = "index"
+	PLAN_CUBE       = "cube"
+)
+
+// Plan is how a query will be executed. RowsScanned is counted as the scan
+// runs, for comparison with the estimate.
+type Plan struct {
+	Strategy      string `json:"strategy"`
+	EstimatedRows int    `json:"estimatedRows"`
+	RowsScanned   int64  `json:"rowsScanned"`
+	scan          ContextIteratorFunc
+}
+
+func newPlan(strategy string, estimatedRows int, scan ContextIteratorFunc) *Plan {
+	return &Plan{Strategy: strategy, EstimatedRows: estimatedRows, scan: scan}
+}
+
+// ScanPlan visits every record of a scan whose size is unknown.
+func ScanPlan(scan ContextIteratorFunc) *Plan {
+	return newPlan(PLAN_SCAN, -1, scan)
+}
+
+// Scan iterates the records of the plan, counting them.
+func (p *Plan) Scan(ctx context.Context, aggregationFunc func(r *Record), sliceIndex int) error {
+	var n int64
+	err := p.scan(ctx, func(r *Record) {
+		n++
+		aggregationFunc(r)
+	}, sliceIndex)
+	atomic.AddInt64(&p.RowsScanned, n)
+	return err
+}
+
+// Planner chooses the access path that visits the fewest rows for a query.
+// The indexes and cube are optional, and Instrument, if set, wraps the scan
+// of every plan, e.g. to time it.
+type Planner struct {
+	Store      *ColumnStore
+	Mutations  *MutationIndex
+	Clades     *CladeIndex
+	Cube       *ColumnStore
+	Threads    int
+	Instrument func(scan ContextIteratorFunc) ContextIteratorFunc
+}
+
+func (q *Query) hasMutations() bool {
+	for _, lineages := range [][]QueryLineage{q.Lineages, q.Excluding} {
+		for _, ql := range lineages {
+			if len(ql.Mutations) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func rangeRows(ranges []recordRange) int {
+	n := 0
+	for _, r := range ranges {
+		n += r.to - r.from
+	}
+	return n
+}
+
+// Plan chooses how to find the records that can match q, where a nil q
+// matches every record. The cube is only considered if allowCube, as the
+// caller must not need anything the cube lacks, and q must not involve
+// mutations or metadata.
+func (p *Planner) Plan(q *Query, allowCube bool) *Plan {
+	plan := p.plan(q, allowCube)
+	if p.Instrument != nil {
+		plan.scan = p.Instrument(plan.scan)
+	}
+	return plan
+}
+
+func (p *Planner) plan(q *Query, allowCube bool) *Plan {
+	s := p.Store
+	if q == nil {
+		return newPlan(PLAN_SCAN, s.Len(), s.Scan(p.Threads))
+	}
+	if allowCube && p.Cube != nil && len(q.Metadata) == 0 && !q.hasMutations() {
+		if ranges, pruned := p.Cube.prune(q); pruned {
+			return newPlan(PLAN_CUBE, rangeRows(ranges), p.Cube.rangesScan(ranges, p.Threads))
+		}
+		return newPlan(PLAN_CUBE, p.Cube.Len(), p.Cube.Scan(p.Threads))
+	}
+
+	best := newPlan(PLAN_SCAN, s.Len(), nil)
+	ranges, pruned := s.prune(q)
+	if pruned {
+		best = newPlan(PLAN_PARTITIONS, rangeRows(ranges), nil)
+	}
+	candidates, indexed := s.candidates(p.Mutations, p.Clades, q.Lineages)
+	if indexed {
+		if pruned {
+			candidates = withinRanges(candidates, ranges)
+		}
+		if len(candidates) < best.EstimatedRows {
+			best = newPlan(PLAN_INDEX, len(candidates), s.idsScan(candidates, p.Threads))
+		}
+	}
+	if best.scan == nil {
+		if pruned {
+			best.scan = s.rangesScan(ranges, p.Threads)
+		} else {
+			best.scan = s.Scan(p.Threads)
+		}
+	}
+	return best
+}
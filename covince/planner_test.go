@@ -0,0 +1,67 @@
+package covince
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanner(t *testing.T) {
+	s := testColumnStore(testDatabase(4000))
+	s.Partition()
+	p := &Planner{Store: s, Threads: 2}
+
+	plan := p.Plan(nil, true)
+	assert.Equal(t, PLAN_SCAN, plan.Strategy)
+	assert.Equal(t, s.Len(), plan.EstimatedRows)
+
+	mutationQuery := Query{Lineages: []QueryLineage{{Key: "B+N:A", PangoClade: "B.", Mutations: []Mutation{{Prefix: "N", Suffix: "A"}}}}}
+	assert.Equal(t, PLAN_SCAN, p.Plan(&mutationQuery, true).Strategy)
+	assert.Equal(t, PLAN_PARTITIONS, p.Plan(&Query{DateFrom: "2021-01-20"}, true).Strategy)
+
+	p.Mutations = CreateMutationIndex(s)
+	p.Clades = CreateCladeIndex(s)
+	p.Cube = s.Cube()
+	for _, c := range []struct {
+		q         Query
+		allowCube bool
+		strategy  string
+	}{
+		{Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}, true, PLAN_CUBE},
+		{Query{Lineages: []QueryLineage{{Key: "B", PangoClade: "B."}}}, false, PLAN_SCAN},
+		{Query{Lineages: []QueryLineage{{Key: "A", PangoClade: "A."}}}, false, PLAN_INDEX},
+		{Query{Metadata: []MetadataFilter{{Column: 0, Values: map[string]bool{"hospital": true}}}, DateTo: "2021-01-02"}, true, PLAN_PARTITIONS},
+		{mutationQuery, true, PLAN_INDEX},
+		{Query{Lineages: mutationQuery.Lineages, DateFrom: "2021-01-28"}, true, PLAN_INDEX},
+	} {
+		q := c.q
+		plan := p.Plan(&q, c.allowCube)
+		assert.Equal(t, c.strategy, plan.Strategy)
+
+		newPartial := func() Partial {
+			return NewAggregatePartial(func(i AggregateIndex, r *Record) {
+				Aggregate(i, &q, []GroupBy{{Name: "date", Dimension: DateDimension}}, r)
+			})
+		}
+		expected, _ := MapReduce(context.Background(), s.Scan(1), 1, newPartial)
+		actual, err := MapReduce(context.Background(), plan.Scan, 2, newPartial)
+		assert.Nil(t, err)
+		assert.Equal(t, expected.(*AggregatePartial).Index, actual.(*AggregatePartial).Index)
+		assert.Equal(t, int64(plan.EstimatedRows), plan.RowsScanned)
+	}
+
+	t.Run("instrumented scans", func(t *testing.T) {
+		scans := 0
+		p.Instrument = func(scan ContextIteratorFunc) ContextIteratorFunc {
+			return func(ctx context.Context, agg func(r *Record), sliceIndex int) error {
+				scans++
+				return scan(ctx, agg, sliceIndex)
+			}
+		}
+		plan := p.Plan(&mutationQuery, true)
+		assert.Nil(t, plan.Scan(context.Background(), func(r *Record) {}, -1))
+		assert.Equal(t, 1, scans)
+		assert.Equal(t, int64(plan.EstimatedRows), plan.RowsScanned)
+	})
+}
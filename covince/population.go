@@ -0,0 +1,56 @@
+package covince
+
+type Population map[string]int
+
+type Rate struct {
+	Count      int     `json:"count"`
+	Per100k    float64 `json:"per_100k,omitempty"`
+	Proportion float64 `json:"proportion,omitempty"`
+}
+
+type RateIndex map[string]map[string]Rate
+
+// Sequenced counts every record by date and area, giving the denominator
+// for normalising by sequencing effort.
+func Sequenced(i Index, r *Record) {
+	dateCounts, ok := i[r.Date.Value]
+	if !ok {
+		dateCounts = make(map[string]int)
+		i[r.Date.Value] = dateCounts
+	}
+	dateCounts[r.Area.Value] += r.Count
+}
+
+// Normalise converts area counts into rates per 100k population and/or
+// proportions of all sequences for the same date and area. Either
+// denominator may be nil to omit that rate.
+func Normalise(i Index, population Population, sequenced Index) RateIndex {
+	rates := make(RateIndex, len(i))
+	for date, areaCounts := range i {
+		dateRates := make(map[string]Rate, len(areaCounts))
+		for area, count := range areaCounts {
+			rate := Rate{Count: count}
+			if p := population[area]; p > 0 {
+				rate.Per100k = float64(count) * 100000 / float64(p)
+			}
+			if total := sequenced[date][area]; total > 0 {
+				rate.Proportion = float64(count) / float64(total)
+			}
+			dateRates[area] = rate
+		}
+		rates[date] = dateRates
+	}
+	return rates
+}
+
+// RollUpPopulation sums base area populations into their ancestors at the
+// given level.
+func (h *AreaHierarchy) RollUpPopulation(p Population, level string) Population {
+	rolled := make(Population)
+	for area, count := range p {
+		if ancestor := h.Ancestor(area, level); ancestor != "" {
+			rolled[ancestor] += count
+		}
+	}
+	return rolled
+}
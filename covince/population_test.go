@@ -0,0 +1,52 @@
+package covince
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequenced(t *testing.T) {
+	i := Index{}
+	for _, r := range testRecords {
+		Sequenced(i, &r)
+	}
+	assert.Equal(t, Index{
+		"2020-09-01": {"A": 1},
+		"2020-10-01": {"B": 2},
+		"2020-11-01": {"C": 3},
+	}, i)
+}
+
+func TestNormalise(t *testing.T) {
+	i := Index{
+		"2020-09-01": {"A": 1, "B": 2},
+	}
+	population := Population{"A": 200000}
+	sequenced := Index{
+		"2020-09-01": {"A": 4, "B": 8},
+	}
+
+	t.Run("by population", func(t *testing.T) {
+		assert.Equal(t, RateIndex{
+			"2020-09-01": {
+				"A": {Count: 1, Per100k: 0.5},
+				"B": {Count: 2},
+			},
+		}, Normalise(i, population, nil))
+	})
+	t.Run("by sequenced", func(t *testing.T) {
+		assert.Equal(t, RateIndex{
+			"2020-09-01": {
+				"A": {Count: 1, Proportion: 0.25},
+				"B": {Count: 2, Proportion: 0.25},
+			},
+		}, Normalise(i, nil, sequenced))
+	})
+}
+
+func TestRollUpPopulation(t *testing.T) {
+	h := testHierarchy()
+	population := Population{"A": 1, "B": 2, "C": 3, "D": 4}
+	assert.Equal(t, Population{"North": 3, "South": 3}, h.RollUpPopulation(population, "region"))
+}
@@ -1,9 +1,9 @@
 package covince
 
 import (
+	"context"
 	"fmt"
 	"sort"
-	"sync"
 	"time"
 
 	"github.com/covince/covince-backend-v2/perf"
@@ -68,47 +68,20 @@ type SearchOpts struct {
 }
 
 func SearchMutations(foreach IteratorFunc, q *Query, opts *SearchOpts) SearchResult {
-	m := make(map[string]*MutationSearch)
-	totalRecords := MutationSearch{}
+	result, _ := SearchMutationsContext(context.Background(), WithContext(foreach), q, opts)
+	return result
+}
 
-	if opts.Threads > 1 {
-		var wg sync.WaitGroup
-		wg.Add(opts.Threads)
-		results := make([]map[string]*MutationSearch, opts.Threads)
-		totals := make([]MutationSearch, opts.Threads)
-		for i := 0; i < opts.Threads; i++ {
-			go func(slice int) {
-				m := make(map[string]*MutationSearch)
-				results[slice] = m
-				foreach(func(r *Record) {
-					Mutations(m, &totals[slice], opts, q, r)
-				}, slice)
-				wg.Done()
-			}(i)
-		}
-		wg.Wait()
-		startSum := time.Now()
-		for i := 0; i < opts.Threads; i++ {
-			for k, v := range results[i] {
-				if sr, ok := m[k]; ok {
-					sr.Count += v.Count
-					sr.growthStart += v.growthStart
-					sr.growthEnd += v.growthEnd
-				} else {
-					m[k] = v
-				}
-			}
-			t := totals[i]
-			totalRecords.Count += t.Count
-			totalRecords.growthStart += t.growthStart
-			totalRecords.growthEnd += t.growthEnd
-		}
-		perf.LogDuration("summing", startSum)
-	} else {
-		foreach(func(r *Record) {
-			Mutations(m, &totalRecords, opts, q, r)
-		}, -1)
+// SearchMutationsContext stops scanning once ctx is done, including every
+// slice of a threaded search, and returns ctx.Err() without sorting.
+func SearchMutationsContext(ctx context.Context, scan ContextIteratorFunc, q *Query, opts *SearchOpts) (SearchResult, error) {
+	p, err := MapReduce(ctx, scan, opts.Threads, func() Partial {
+		return NewMutationsPartial(opts, q)
+	})
+	if err != nil {
+		return SearchResult{}, err
 	}
+	m, totalRecords := p.(*MutationsPartial).Mutations, p.(*MutationsPartial).Total
 
 	fmt.Println("num muts:", len(m))
 	startSort := time.Now()
@@ -167,5 +140,5 @@ func SearchMutations(foreach IteratorFunc, q *Query, opts *SearchOpts) SearchRes
 		i++
 	}
 	perf.LogDuration("sorting", startSort)
-	return result
+	return result, nil
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/covince/covince-backend-v2/covince"
+)
+
+// the prefix of the line that starts each delta in the journal, followed by
+// the last modified time of the version it produced
+const JOURNAL_HEADER = "# "
+
+// the prefix of the line that ends each delta, followed by its number of
+// rows, so that a delta cut short by a crash can be told apart
+const JOURNAL_END = "# end "
+
+var errNotJournaled = errors.New("delta applied but not journaled")
+
+// journal appends each delta applied to the dataset to a file, in the
+// format of the csv file, so that the deltas survive a restart. A nil
+// journal only applies them.
+type journal struct {
+	mu   sync.Mutex
+	path string
+}
+
+func formatDeltaRow(r *covince.Row) string {
+	count := TOMBSTONE
+	if !r.Deleted {
+		count = strconv.Itoa(r.Count)
+	}
+	row := []string{r.Area, r.Date, "", r.PangoClade, strings.Join(r.Mutations, "|"), count}
+	return strings.Join(append(row, r.Metadata...), ",")
+}
+
+func writeDelta(w io.Writer, rows []covince.Row, lastModified int64) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "%v%v\n", JOURNAL_HEADER, lastModified)
+	for i := range rows {
+		fmt.Fprintln(b, formatDeltaRow(&rows[i]))
+	}
+	fmt.Fprintf(b, "%v%v\n", JOURNAL_END, len(rows))
+	return b.Flush()
+}
+
+// upsert applies the rows to the dataset and then journals them, holding
+// the lock so that deltas are journaled in the order they were applied.
+func (j *journal) upsert(dataset *covince.Dataset, rows []covince.Row, lastModified int64) (covince.UpsertResult, error) {
+	if j == nil {
+		return dataset.Upsert(rows, ":", lastModified)
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	result, err := dataset.Upsert(rows, ":", lastModified)
+	if err != nil || len(rows) == 0 {
+		return result, err
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", errNotJournaled, err)
+	}
+	defer f.Close()
+	if err := writeDelta(f, rows, result.LastModified); err != nil {
+		return result, fmt.Errorf("%w: %v", errNotJournaled, err)
+	}
+	if err := f.Sync(); err != nil {
+		return result, fmt.Errorf("%w: %v", errNotJournaled, err)
+	}
+	return result, nil
+}
+
+// replay applies the deltas of the journal that are newer than since, which
+// is the last modified time of the csv file, as older deltas are taken to be
+// included in it. It returns the number of deltas applied. A final delta
+// without its end was cut short while being written, so it is dropped and
+// truncated from the journal for the next delta to be appended cleanly.
+func (j *journal) replay(dataset *covince.Dataset, columns int, since int64) (int, error) {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	applied := 0
+	var rows []covince.Row
+	var lastModified int64
+	// the line of the header of the delta being read, if any, and the
+	// offset of the end of the last complete delta
+	header := 0
+	var offset, complete int64
+	for line := 1; ; line++ {
+		text, err := r.ReadString('\n')
+		if err == io.EOF {
+			if header > 0 || text != "" {
+				// the header itself may have been cut short
+				if header == 0 {
+					header = line
+				}
+				log.Println("Dropping the incomplete delta from line", header, "of the journal")
+				return applied, os.Truncate(j.path, complete)
+			}
+			return applied, nil
+		}
+		if err != nil {
+			return applied, err
+		}
+		offset += int64(len(text))
+		text = strings.TrimSuffix(text, "\n")
+		switch {
+		case text == "":
+		case strings.HasPrefix(text, JOURNAL_END):
+			if n, err := strconv.Atoi(text[len(JOURNAL_END):]); err != nil || header == 0 || n != len(rows) {
+				return applied, fmt.Errorf("line %v: invalid end %q", line, text)
+			}
+			if lastModified > since && len(rows) > 0 {
+				if _, err := dataset.Upsert(rows, ":", lastModified); err != nil {
+					return applied, err
+				}
+				applied++
+			}
+			header, complete = 0, offset
+		case strings.HasPrefix(text, JOURNAL_HEADER):
+			if header > 0 {
+				return applied, fmt.Errorf("line %v: delta from line %v has no end", line, header)
+			}
+			if lastModified, err = strconv.ParseInt(text[len(JOURNAL_HEADER):], 10, 64); err != nil {
+				return applied, fmt.Errorf("line %v: invalid header %q", line, text)
+			}
+			header, rows = line, nil
+		default:
+			if header == 0 {
+				return applied, fmt.Errorf("line %v: row outside a delta", line)
+			}
+			row, err := parseDeltaRow(strings.Split(text, ","), columns)
+			if err != nil {
+				return applied, fmt.Errorf("line %v: %w", line, err)
+			}
+			rows = append(rows, row)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/covince/covince-backend-v2/covince"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournal(t *testing.T) {
+	j := &journal{path: filepath.Join(t.TempDir(), "deltas.journal")}
+	opts := testAdminOpts()
+	added := covince.Row{Area: "E2", Date: "2021-01-02", PangoClade: "C.", Mutations: []string{"S:N501Y", "S:D614G"}, Metadata: []string{"community"}, Count: 4}
+	deleted := covince.Row{Area: "E1", Date: "2021-01-01", PangoClade: "B.", Mutations: []string{"S:D614G"}, Metadata: []string{"community"}, Deleted: true}
+
+	first, err := j.upsert(opts.Dataset, []covince.Row{added}, 2000)
+	assert.Nil(t, err)
+	_, err = j.upsert(opts.Dataset, []covince.Row{{Metadata: []string{"community"}, Mutations: []string{"S"}}}, 2500)
+	assert.Error(t, err)
+	second, err := j.upsert(opts.Dataset, []covince.Row{deleted}, 1500)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2001), second.LastModified)
+
+	replay := func(since int64) (*covince.Dataset, int) {
+		dataset := testAdminOpts().Dataset
+		replayed, err := j.replay(dataset, 1, since)
+		assert.Nil(t, err)
+		return dataset, replayed
+	}
+	dataset, replayed := replay(1000)
+	assert.Equal(t, 2, replayed)
+	assert.Equal(t, second.LastModified, dataset.Current().LastModified)
+	result, _ := dataset.Upsert(nil, ":", 0)
+	assert.Equal(t, second.Records, result.Records)
+
+	t.Run("deltas older than the csv file are skipped", func(t *testing.T) {
+		dataset, replayed := replay(first.LastModified)
+		assert.Equal(t, 1, replayed)
+		assert.Equal(t, second.LastModified, dataset.Current().LastModified)
+		dataset, replayed = replay(3000)
+		assert.Equal(t, 0, replayed)
+		assert.Equal(t, int64(1000), dataset.Current().LastModified)
+	})
+
+	t.Run("a missing journal has no deltas", func(t *testing.T) {
+		replayed, err := (&journal{path: filepath.Join(t.TempDir(), "missing")}).replay(testAdminOpts().Dataset, 1, 0)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, replayed)
+	})
+
+	t.Run("an invalid journal", func(t *testing.T) {
+		invalid := &journal{path: filepath.Join(t.TempDir(), "invalid")}
+		os.WriteFile(invalid.path, []byte("# 2000\nE1,2021-01-01,B,B.,,2,community\n# end 1\n# never\n"), 0644)
+		replayed, err := invalid.replay(testAdminOpts().Dataset, 1, 1000)
+		assert.EqualError(t, err, `line 4: invalid header "# never"`)
+		assert.Equal(t, 1, replayed)
+
+		os.WriteFile(invalid.path, []byte("# 2000\nE1,2021-01-01,B,B.,,2,community\n# end 2\n"), 0644)
+		_, err = invalid.replay(testAdminOpts().Dataset, 1, 1000)
+		assert.EqualError(t, err, `line 3: invalid end "# end 2"`)
+	})
+
+	t.Run("a journal truncated mid-row", func(t *testing.T) {
+		truncated := &journal{path: filepath.Join(t.TempDir(), "truncated")}
+		dataset := testAdminOpts().Dataset
+		_, err := truncated.upsert(dataset, []covince.Row{added}, 2000)
+		assert.Nil(t, err)
+		info, _ := os.Stat(truncated.path)
+		complete := info.Size()
+		_, err = truncated.upsert(dataset, []covince.Row{deleted, added}, 3000)
+		assert.Nil(t, err)
+		info, _ = os.Stat(truncated.path)
+		// mid-row, between rows, and short of the newline of the end
+		for _, size := range []int64{complete + 8, complete + 45, complete + 90, info.Size() - 1} {
+			assert.Nil(t, os.Truncate(truncated.path, size))
+			replayed, err := truncated.replay(testAdminOpts().Dataset, 1, 1000)
+			assert.Nil(t, err)
+			assert.Equal(t, 1, replayed)
+			info, _ = os.Stat(truncated.path)
+			assert.Equal(t, complete, info.Size())
+		}
+
+		// the next delta follows the last complete one
+		_, err = truncated.upsert(dataset, []covince.Row{deleted}, 3000)
+		assert.Nil(t, err)
+		replayed, err := truncated.replay(testAdminOpts().Dataset, 1, 1000)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, replayed)
+	})
+
+	t.Run("a journal that can't be written", func(t *testing.T) {
+		unwritable := &journal{path: filepath.Join(t.TempDir(), "missing", "deltas.journal")}
+		_, err := unwritable.upsert(opts.Dataset, []covince.Row{added}, 0)
+		assert.ErrorIs(t, err, errNotJournaled)
+	})
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"log"
 	"net/http"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -14,13 +16,28 @@ import (
 	"github.com/covince/covince-backend-v2/perf"
 )
 
-func addRecordToDatabase(db *covince.Database, row []string) {
+type config struct {
+	FilePath        string
+	AreasPath       string
+	PopulationPath  string
+	BoundariesPath  string
+	JournalPath     string
+	URLPath         string
+	MetadataColumns []string
+	// bytes the data may take, or zero for no limit
+	MemoryLimit int
+}
+
+// how many rows are loaded between checks of the memory limit
+const LOAD_CHECK_INTERVAL = 1 << 18
+
+func addRecordToDatabase(db *covince.Database, store *covince.ColumnStore, row []string) {
 	count, _ := strconv.Atoi(row[5])
-	db.Records = append(
-		db.Records,
-		covince.Record{
-			Area: db.IndexValue(row[0]),
-			Date: db.IndexValue(row[1]),
+	store.Append(
+		&covince.Record{
+			Metadata: db.IndexMetadata(row[6 : 6+len(db.Columns)]),
+			Area:     db.IndexValue(row[0]),
+			Date:     db.IndexValue(row[1]),
 			// Lineage:    db.IndexValue(row[2]),
 			PangoClade: db.IndexValue(row[3]),
 			Mutations:  db.IndexMutations(strings.Split(row[4], "|"), ":"),
@@ -29,8 +46,93 @@ func addRecordToDatabase(db *covince.Database, row []string) {
 	)
 }
 
-func server(filePath string, urlPath string) http.HandlerFunc {
+func loadAreaHierarchy(filePath string) *covince.AreaHierarchy {
 	csvfile, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatalln("Couldn't open the area hierarchy file", err)
+	}
+	defer csvfile.Close()
+	scanner := bufio.NewScanner(csvfile)
+
+	// header row names each level, starting with the base areas
+	if !scanner.Scan() {
+		log.Fatalln("Area hierarchy file is empty")
+	}
+	h := covince.CreateAreaHierarchy(strings.Split(scanner.Text(), ","))
+
+	for scanner.Scan() {
+		if err := h.AddArea(strings.Split(scanner.Text(), ",")); err != nil {
+			log.Fatalln("Couldn't load the area hierarchy", err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	log.Println("area levels:", h.Levels)
+	return h
+}
+
+func loadPopulation(filePath string) covince.Population {
+	csvfile, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatalln("Couldn't open the population file", err)
+	}
+	defer csvfile.Close()
+	scanner := bufio.NewScanner(csvfile)
+	population := make(covince.Population)
+
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		row := strings.Split(scanner.Text(), ",")
+		if len(row) < 2 {
+			log.Fatalln("Expected an area and population on line", line, "of the population file")
+		}
+		count, err := strconv.Atoi(row[1])
+		if err != nil {
+			log.Fatalln("Invalid population for area", row[0], err)
+		}
+		population[row[0]] = count
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	log.Println(len(population), "area populations")
+	return population
+}
+
+func loadBoundaries(filePath string) api.Boundaries {
+	geojsonfile, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		log.Fatalln("Couldn't open the boundaries file", err)
+	}
+	defer geojsonfile.Close()
+
+	boundaries, err := api.ParseBoundaries(bufio.NewReader(geojsonfile), "")
+	if err != nil {
+		log.Fatalln("Couldn't parse the boundaries file", err)
+	}
+
+	log.Println(len(boundaries), "area boundaries")
+	return boundaries
+}
+
+func server(c config) (http.HandlerFunc, adminOpts) {
+	csvfile, err := os.Open(c.FilePath)
 	if err != nil {
 		log.Fatalln("Couldn't open the csv file", err)
 	}
@@ -40,42 +142,101 @@ func server(filePath string, urlPath string) http.HandlerFunc {
 	}
 	scanner := bufio.NewScanner(csvfile)
 	db := covince.CreateDatabase()
+	// extra categorical columns follow the count
+	db.Columns = c.MetadataColumns
 
 	buf := []byte{}
 	// increase the buffer size to 2Mb
 	scanner.Buffer(buf, 2048*1024)
 
+	store := covince.CreateColumnStore(db)
+	// refuse to load more than the limit, rather than be killed for it
+	checkMemory := func() {
+		if c.MemoryLimit == 0 {
+			return
+		}
+		if f := (&covince.Planner{Store: store}).Footprint(); f.Total > c.MemoryLimit {
+			log.Fatalln("Couldn't load the csv file:", f.Total/1024/1024, "MB exceeds the memory limit of", c.MemoryLimit/1024/1024, "MB")
+		}
+	}
 	for scanner.Scan() {
 		row := strings.Split(scanner.Text(), ",")
-		addRecordToDatabase(db, row)
+		addRecordToDatabase(db, store, row)
+		if store.Len()%LOAD_CHECK_INTERVAL == 0 {
+			checkMemory()
+		}
 	}
 
 	if err := scanner.Err(); err != nil {
 		log.Fatalf("%v", err)
 	}
 
-	log.Println(len(db.Records), "records")
-	for k := range db.MutationLookup {
-		delete(db.MutationLookup, k)
-	}
+	log.Println(store.Len(), "records,", store.Size()/1024/1024, "MB")
 
 	opts := api.Opts{
-		PathPrefix:       urlPath,
+		AreaHierarchy:    loadAreaHierarchy(c.AreasPath),
+		Boundaries:       loadBoundaries(c.BoundariesPath),
+		PathPrefix:       c.URLPath,
+		Population:       loadPopulation(c.PopulationPath),
+		MetadataColumns:  db.Columns,
 		MaxLineages:      16,
 		Genes:            db.Genes,
 		MaxSearchResults: 32,
+		Cache:            api.NewResultCache(64 * 1024 * 1024),
+		Timeout:          30 * time.Second,
+		Threads:          runtime.NumCPU(),
 		LastModified:     stat.ModTime().UnixMilli(),
 	}
 
-	foreach := func(agg func(r *covince.Record), sliceIndex int) {
-		start := time.Now()
-		for _, r := range db.Records {
-			agg(&r)
+	start := time.Now()
+	merged := store.Deduplicate()
+	log.Println(merged, "duplicate rows merged,", store.Len(), "records,", store.Size()/1024/1024, "MB")
+	checkMemory()
+	store.Partition()
+	perf.LogDuration("Partitioning", start)
+	log.Println(len(store.Partitions), "partitions")
+	start = time.Now()
+	logDuration := func(scan covince.ContextIteratorFunc) covince.ContextIteratorFunc {
+		return func(ctx context.Context, agg func(r *covince.Record), sliceIndex int) error {
+			start := time.Now()
+			err := scan(ctx, agg, sliceIndex)
+			perf.LogDuration("Aggregation", start)
+			return err
 		}
-		perf.LogDuration("Aggregation", start)
+	}
+	planner := &covince.Planner{Store: store, Threads: opts.Threads, Instrument: logDuration}
+	if skipped := planner.IndexWithin(c.MemoryLimit); len(skipped) > 0 {
+		log.Println("Skipped indexes over the memory limit:", skipped)
+	}
+	perf.LogDuration("Indexes", start)
+	if planner.Cube != nil {
+		log.Println(planner.Cube.Len(), "cube cells")
+	}
+	log.Println(planner.Footprint().Total/1024/1024, "MB of data")
+	// records can be updated, so each version is served as a whole
+	opts.Dataset = covince.CreateDataset(planner, opts.LastModified)
+	opts.Dataset.Limit = c.MemoryLimit
+
+	// deltas since the csv file was written, so the last modified time of
+	// the data never goes back
+	deltas := &journal{path: c.JournalPath}
+	start = time.Now()
+	replayed, err := deltas.replay(opts.Dataset, len(db.Columns), opts.LastModified)
+	if err != nil {
+		log.Fatalln("Couldn't replay the journal", err)
+	}
+	if replayed > 0 {
+		perf.LogDuration("Journal", start)
+		log.Println(replayed, "deltas replayed,", opts.Dataset.Current().Planner.Store.Len(), "records")
 	}
 
-	return api.CovinceAPI(opts, foreach)
+	return api.CovinceAPI(opts, nil), adminOpts{
+		Dataset:     opts.Dataset,
+		Cache:       opts.Cache,
+		Journal:     deltas,
+		Columns:     len(db.Columns),
+		MemoryLimit: c.MemoryLimit,
+	}
 }
 
 // func serverless(filePath string) http.HandlerFunc {
@@ -123,9 +284,33 @@ func server(filePath string, urlPath string) http.HandlerFunc {
 func main() {
 	start := time.Now()
 
-	filePath := "aggregated.csv"
-	urlPath := "/api"
-	http.HandleFunc("/api/", server(filePath, urlPath))
+	c := config{
+		FilePath:       "aggregated.csv",
+		AreasPath:      "areas.csv",
+		PopulationPath: "population.csv",
+		BoundariesPath: "boundaries.geojson",
+		JournalPath:    "deltas.journal",
+		URLPath:        "/api",
+	}
+	if columns := os.Getenv("METADATA_COLUMNS"); columns != "" {
+		c.MetadataColumns = strings.Split(columns, ",")
+		if err := api.CheckMetadataColumns(c.MetadataColumns); err != nil {
+			log.Fatalln("Invalid METADATA_COLUMNS", err)
+		}
+	}
+	if limit := os.Getenv("MEMORY_LIMIT_MB"); limit != "" {
+		mb, err := strconv.Atoi(limit)
+		if err != nil {
+			log.Fatalln("Invalid MEMORY_LIMIT_MB", err)
+		}
+		c.MemoryLimit = mb * 1024 * 1024
+	}
+	handler, options := server(c)
+	http.HandleFunc("/api/", handler)
+	if token := os.Getenv("ADMIN_TOKEN"); token != "" {
+		options.Token = token
+		http.HandleFunc("/admin/", admin(options))
+	}
 	// http.HandleFunc("/", serverless(filePath))
 
 	perf.LogDuration("startup", start)